@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ARPRequest = 1
+	ARPReply   = 2
+
+	arpHardwareEthernet = 1
+	arpPacketLen        = 28
+
+	arpRetryInterval      = time.Second
+	arpMaxRequests        = 3
+	neighborReachableTime = 30 * time.Second //Then the entry is refreshed while still used
+	neighborQueueLen      = 16               //Packets waiting for a resolution
+)
+
+// ARP for IPv4 over Ethernet (RFC 826)
+type ARPPacket struct {
+	HardwareType uint16
+	ProtocolType uint16
+	Operation    uint16
+	SenderMAC    net.HardwareAddr
+	SenderIP     uint32
+	TargetMAC    net.HardwareAddr
+	TargetIP     uint32
+}
+
+func NewARPPacket(data []byte) (*ARPPacket, error) {
+	if len(data) < arpPacketLen || data[4] != 6 || data[5] != 4 {
+		return nil, fmt.Errorf("Not an IPv4 over Ethernet ARP packet")
+	}
+	return &ARPPacket{
+		HardwareType: binary.BigEndian.Uint16(data[0:2]),
+		ProtocolType: binary.BigEndian.Uint16(data[2:4]),
+		Operation:    binary.BigEndian.Uint16(data[6:8]),
+		SenderMAC:    net.HardwareAddr(data[8:14]),
+		SenderIP:     binary.BigEndian.Uint32(data[14:18]),
+		TargetMAC:    net.HardwareAddr(data[18:24]),
+		TargetIP:     binary.BigEndian.Uint32(data[24:28])}, nil
+}
+
+func (p *ARPPacket) Marshall() []byte {
+	output := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(output[0:2], p.HardwareType)
+	binary.BigEndian.PutUint16(output[2:4], p.ProtocolType)
+	output[4] = 6
+	output[5] = 4
+	binary.BigEndian.PutUint16(output[6:8], p.Operation)
+	copy(output[8:14], p.SenderMAC)
+	binary.BigEndian.PutUint32(output[14:18], p.SenderIP)
+	copy(output[18:24], p.TargetMAC)
+	binary.BigEndian.PutUint32(output[24:28], p.TargetIP)
+	return output
+}
+
+type neighbor struct {
+	mac       net.HardwareAddr //nil until resolved
+	confirmed time.Time
+	requests  int
+	timer     *time.Timer //Pending request retry
+	pending   [][]byte    //IP packets waiting for the resolution
+}
+
+// Neighbor cache of an Ethernet link. request sends an ARP request, send
+// the packets queued during a resolution once it completes.
+type neighborCache struct {
+	mu      sync.Mutex
+	entries map[uint32]*neighbor
+	request func(ip uint32)
+	send    func(mac net.HardwareAddr, packet []byte)
+	retry   time.Duration //Between two requests
+}
+
+func newNeighborCache(request func(ip uint32), send func(mac net.HardwareAddr, packet []byte)) *neighborCache {
+	return &neighborCache{
+		entries: make(map[uint32]*neighbor),
+		request: request,
+		send:    send,
+		retry:   arpRetryInterval}
+}
+
+// Returns the hardware address of ip, or queues packet and starts the
+// resolution
+func (c *neighborCache) resolve(ip uint32, packet []byte) (net.HardwareAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entries[ip]
+	if e != nil && e.mac != nil {
+		if time.Since(e.confirmed) > neighborReachableTime && e.timer == nil {
+			c.startRequests(ip, e)
+		}
+		return e.mac, true
+	}
+
+	if e == nil {
+		e = &neighbor{}
+		c.entries[ip] = e
+		c.startRequests(ip, e)
+	}
+	if len(e.pending) < neighborQueueLen {
+		e.pending = append(e.pending, packet)
+	} else {
+		fmt.Println("ARP: queue full for", DecodeIPV4Addr(ip), "packet dropped")
+	}
+	return nil, false
+}
+
+// Must be called with mu held
+func (c *neighborCache) startRequests(ip uint32, e *neighbor) {
+	e.requests = 0
+	c.sendRequest(ip, e)
+}
+
+// Must be called with mu held
+func (c *neighborCache) sendRequest(ip uint32, e *neighbor) {
+	e.requests++
+	c.request(ip)
+	e.timer = time.AfterFunc(c.retry, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.entries[ip] != e || e.timer == nil {
+			return
+		}
+		e.timer = nil
+		if e.requests >= arpMaxRequests {
+			fmt.Println("ARP: no reply from", DecodeIPV4Addr(ip), len(e.pending), "packets dropped")
+			delete(c.entries, ip)
+			return
+		}
+		c.sendRequest(ip, e)
+	})
+}
+
+// Mapping learned from an ARP packet. A new entry is only created when the
+// packet was for us, others are just refreshed (RFC 826 merge).
+func (c *neighborCache) update(ip uint32, mac net.HardwareAddr, create bool) {
+	c.mu.Lock()
+	e := c.entries[ip]
+	if e == nil {
+		if !create {
+			c.mu.Unlock()
+			return
+		}
+		e = &neighbor{}
+		c.entries[ip] = e
+	}
+	e.mac = append(net.HardwareAddr(nil), mac...)
+	e.confirmed = time.Now()
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	mac, pending := e.mac, e.pending
+	e.pending = nil
+	c.mu.Unlock()
+
+	for _, packet := range pending {
+		c.send(mac, packet)
+	}
+}
+
+func (c *neighborCache) close() {
+	c.mu.Lock()
+	for ip, e := range c.entries {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		delete(c.entries, ip)
+	}
+	c.mu.Unlock()
+}
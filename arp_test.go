@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Neighbor cache recording its requests and the packets it sends
+type recordingNeighbors struct {
+	*neighborCache
+
+	mu       sync.Mutex
+	requests int
+	sent     []string
+}
+
+func newRecordingNeighbors(retry time.Duration) *recordingNeighbors {
+	r := &recordingNeighbors{}
+	r.neighborCache = newNeighborCache(func(ip uint32) {
+		r.mu.Lock()
+		r.requests++
+		r.mu.Unlock()
+	}, func(mac net.HardwareAddr, packet []byte) {
+		r.mu.Lock()
+		r.sent = append(r.sent, string(packet))
+		r.mu.Unlock()
+	})
+	r.retry = retry
+	return r
+}
+
+func (r *recordingNeighbors) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests, len(r.sent)
+}
+
+func (r *recordingNeighbors) hasEntry(ip uint32) bool {
+	r.neighborCache.mu.Lock()
+	defer r.neighborCache.mu.Unlock()
+	return r.entries[ip] != nil
+}
+
+// Without reply the request is sent arpMaxRequests times, then the entry
+// and its pending packets are dropped
+func TestNeighborResolutionRetries(t *testing.T) {
+	r := newRecordingNeighbors(20 * time.Millisecond)
+	defer r.close()
+
+	if _, ok := r.resolve(1, []byte("first")); ok {
+		t.Fatal("resolved without a reply")
+	}
+	r.resolve(1, []byte("second"))
+	if requests, _ := r.counts(); requests != 1 {
+		t.Fatal(requests, "requests for a single resolution")
+	}
+
+	time.Sleep(time.Duration(arpMaxRequests+2) * 20 * time.Millisecond)
+	requests, sent := r.counts()
+	if requests != arpMaxRequests || sent != 0 {
+		t.Fatal(requests, "requests,", sent, "packets sent")
+	}
+	if r.hasEntry(1) {
+		t.Fatal("unresolved entry kept")
+	}
+
+	//A new resolution starts over
+	r.resolve(1, []byte("third"))
+	if requests, _ := r.counts(); requests != arpMaxRequests+1 {
+		t.Fatal(requests, "requests")
+	}
+}
+
+func TestNeighborPendingQueue(t *testing.T) {
+	r := newRecordingNeighbors(time.Hour)
+	defer r.close()
+
+	for i := 0; i < neighborQueueLen+4; i++ {
+		r.resolve(1, []byte{byte(i)})
+	}
+	r.update(1, ethPeer, true)
+	r.mu.Lock()
+	sent := r.sent
+	r.mu.Unlock()
+	if len(sent) != neighborQueueLen {
+		t.Fatal(len(sent), "packets sent, the queue holds", neighborQueueLen)
+	}
+	for i, packet := range sent {
+		if packet != string([]byte{byte(i)}) {
+			t.Fatal("packet", i, "out of order")
+		}
+	}
+
+	if mac, ok := r.resolve(1, nil); !ok || mac.String() != ethPeer.String() {
+		t.Fatal("not resolved after the reply:", mac)
+	}
+}
+
+// Only a packet for us creates an entry, others refresh the existing ones
+func TestNeighborUpdateMerge(t *testing.T) {
+	r := newRecordingNeighbors(time.Hour)
+	defer r.close()
+
+	r.update(1, ethPeer, false)
+	if r.hasEntry(1) {
+		t.Fatal("entry created by a packet for another host")
+	}
+	r.resolve(2, []byte("pending"))
+	r.update(2, ethPeer, false)
+	if _, sent := r.counts(); sent != 1 {
+		t.Fatal("pending resolution not completed by a merge")
+	}
+}
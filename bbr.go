@@ -0,0 +1,279 @@
+package main
+
+import (
+	"time"
+)
+
+type bbrState int
+
+const (
+	bbrStartup bbrState = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+const (
+	bbrHighGain        = 2.885 // 2/ln(2)
+	bbrCwndGain        = 2.0
+	bbrBtlBwFilterLen  = 10 //Rounds
+	bbrMinRTTFilterLen = 10 * time.Second
+	bbrProbeRTTTime    = 200 * time.Millisecond
+	bbrMinCwndSegments = 4
+)
+
+var bbrPacingGainCycle = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrDelivery struct {
+	at        time.Time
+	delivered int
+}
+
+// BBR v1 model based congestion control. Bandwidth is in bytes per second.
+type BBR struct {
+	mss   int
+	state bbrState
+	cwnd  int
+
+	btlBw       float64
+	bwSamples   [bbrBtlBwFilterLen]float64 //Max delivery rate of each of the last rounds
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	pacingGain float64
+	cwndGain   float64
+	cycleIndex int
+	cycleStamp time.Time
+
+	delivered          int
+	history            []bbrDelivery
+	roundCount         int
+	nextRoundDelivered int
+
+	fullBw      float64
+	fullBwCount int
+	filledPipe  bool
+
+	probeRTTDone time.Time
+	priorCwnd    int
+	lossRecovery bool
+
+	now clock
+}
+
+func NewBBR(mss int) *BBR {
+	return &BBR{
+		mss:        mss,
+		state:      bbrStartup,
+		cwnd:       initialWindow(mss),
+		pacingGain: bbrHighGain,
+		cwndGain:   bbrHighGain,
+		now:        time.Now}
+}
+
+func (b *BBR) setClock(now clock) {
+	b.now = now
+}
+
+func (b *BBR) OnAck(acked int, rtt time.Duration, inFlight int) {
+	now := b.now()
+	if b.lossRecovery {
+		//First ACK after the recovery: restore the window saved on loss
+		b.lossRecovery = false
+		if b.priorCwnd > b.cwnd {
+			b.cwnd = b.priorCwnd
+		}
+	}
+	b.delivered += acked
+	b.history = append(b.history, bbrDelivery{now, b.delivered})
+
+	roundStart := false
+	if b.delivered >= b.nextRoundDelivered {
+		b.nextRoundDelivered = b.delivered + inFlight
+		b.roundCount++
+		b.bwSamples[b.roundCount%bbrBtlBwFilterLen] = 0
+		roundStart = true
+	}
+
+	minRTTExpired := !b.minRTTStamp.IsZero() && now.Sub(b.minRTTStamp) > bbrMinRTTFilterLen
+	if rtt > 0 && (b.minRTT == 0 || rtt <= b.minRTT || minRTTExpired) {
+		b.minRTT = rtt
+		b.minRTTStamp = now
+		minRTTExpired = false
+	}
+
+	b.updateBtlBw(now)
+
+	switch b.state {
+	case bbrStartup:
+		if roundStart {
+			b.checkFullPipe()
+		}
+		if b.filledPipe {
+			b.state = bbrDrain
+			b.pacingGain = 1 / bbrHighGain
+			b.cwndGain = bbrHighGain
+		}
+	case bbrDrain:
+		if inFlight <= b.bdp(1) {
+			b.enterProbeBW(now)
+		}
+	case bbrProbeBW:
+		b.advanceCycle(now, inFlight)
+	case bbrProbeRTT:
+		if now.After(b.probeRTTDone) {
+			b.minRTTStamp = now
+			b.cwnd = b.priorCwnd
+			if b.filledPipe {
+				b.enterProbeBW(now)
+			} else {
+				b.state = bbrStartup
+				b.pacingGain = bbrHighGain
+				b.cwndGain = bbrHighGain
+			}
+		}
+	}
+
+	if minRTTExpired && b.state != bbrProbeRTT {
+		b.state = bbrProbeRTT
+		b.pacingGain = 1
+		b.priorCwnd = b.cwnd
+		b.probeRTTDone = now.Add(bbrProbeRTTTime)
+	}
+
+	b.updateCwnd(acked)
+}
+
+// Delivery rate over the last min RTT, fed into a windowed max filter
+func (b *BBR) updateBtlBw(now time.Time) {
+	interval := b.minRTT
+	if interval == 0 {
+		return
+	}
+
+	//Keep one entry older than the interval as the start of the sample
+	i := 0
+	for i+1 < len(b.history) && now.Sub(b.history[i+1].at) >= interval {
+		i++
+	}
+	b.history = b.history[i:]
+
+	start := b.history[0]
+	elapsed := now.Sub(start.at)
+	if elapsed < interval/2 {
+		return
+	}
+	rate := float64(b.delivered-start.delivered) / elapsed.Seconds()
+
+	slot := b.roundCount % bbrBtlBwFilterLen
+	if rate > b.bwSamples[slot] {
+		b.bwSamples[slot] = rate
+	}
+	b.btlBw = 0
+	for _, sample := range b.bwSamples {
+		if sample > b.btlBw {
+			b.btlBw = sample
+		}
+	}
+}
+
+// Full pipe once the bandwidth did not grow by 25% for three rounds
+func (b *BBR) checkFullPipe() {
+	if b.btlBw >= b.fullBw*1.25 {
+		b.fullBw = b.btlBw
+		b.fullBwCount = 0
+		return
+	}
+	b.fullBwCount++
+	if b.fullBwCount >= 3 {
+		b.filledPipe = true
+	}
+}
+
+func (b *BBR) enterProbeBW(now time.Time) {
+	b.state = bbrProbeBW
+	b.cwndGain = bbrCwndGain
+	b.cycleIndex = 1 + int(now.UnixNano()%int64(len(bbrPacingGainCycle)-1)) //Never start by probing up
+	b.cycleStamp = now
+	b.pacingGain = bbrPacingGainCycle[b.cycleIndex]
+}
+
+func (b *BBR) advanceCycle(now time.Time, inFlight int) {
+	elapsed := now.Sub(b.cycleStamp) > b.minRTT
+	switch {
+	case b.pacingGain > 1:
+		elapsed = elapsed && inFlight >= b.bdp(b.pacingGain)
+	case b.pacingGain < 1:
+		elapsed = elapsed || inFlight <= b.bdp(1)
+	}
+	if !elapsed {
+		return
+	}
+
+	b.cycleIndex = (b.cycleIndex + 1) % len(bbrPacingGainCycle)
+	b.cycleStamp = now
+	b.pacingGain = bbrPacingGainCycle[b.cycleIndex]
+}
+
+func (b *BBR) bdp(gain float64) int {
+	if b.btlBw == 0 || b.minRTT == 0 {
+		return initialWindow(b.mss)
+	}
+	return int(gain * b.btlBw * b.minRTT.Seconds())
+}
+
+func (b *BBR) updateCwnd(acked int) {
+	minCwnd := bbrMinCwndSegments * b.mss
+	if b.state == bbrProbeRTT {
+		b.cwnd = minCwnd
+		return
+	}
+
+	target := b.bdp(b.cwndGain) + 3*b.mss
+	if b.filledPipe {
+		b.cwnd += acked
+		if b.cwnd > target {
+			b.cwnd = target
+		}
+	} else if b.cwnd < target || b.delivered < initialWindow(b.mss) {
+		b.cwnd += acked
+	}
+	if b.cwnd < minCwnd {
+		b.cwnd = minCwnd
+	}
+}
+
+// BBR does not react to isolated losses, it only keeps the packet
+// conservation while the connection recovers.
+func (b *BBR) OnLoss(inFlight int) {
+	b.priorCwnd = b.cwnd
+	b.lossRecovery = true
+	if inFlight < b.cwnd {
+		b.cwnd = inFlight
+	}
+	if b.cwnd < bbrMinCwndSegments*b.mss {
+		b.cwnd = bbrMinCwndSegments * b.mss
+	}
+}
+
+func (b *BBR) OnRTO(inFlight int) {
+	b.priorCwnd = b.cwnd
+	b.lossRecovery = false
+	b.cwnd = b.mss
+}
+
+func (b *BBR) CongestionWindow() int {
+	return b.cwnd
+}
+
+// Pacing rate in bytes per second
+func (b *BBR) PacingRate() float64 {
+	if b.btlBw == 0 {
+		rtt := b.minRTT
+		if rtt == 0 {
+			rtt = time.Millisecond
+		}
+		return bbrHighGain * float64(b.cwnd) / rtt.Seconds()
+	}
+	return b.pacingGain * b.btlBw
+}
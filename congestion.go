@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// CongestionControl is the congestion avoidance algorithm used by the send
+// path of a TeaCPConn. Loss detection (duplicate ACKs, SACK scoreboard, RTO)
+// is done by the connection, the algorithm only decides the window.
+type CongestionControl interface {
+	// New data acknowledged. rtt is zero when no RTT sample was taken.
+	OnAck(acked int, rtt time.Duration, inFlight int)
+	// Loss detected by fast retransmit, entering loss recovery
+	OnLoss(inFlight int)
+	// Retransmission timeout
+	OnRTO(inFlight int)
+	// Congestion window in bytes
+	CongestionWindow() int
+}
+
+// Implemented by the algorithms that pace their output (BBR)
+type PacedCongestionControl interface {
+	CongestionControl
+	// Pacing rate in bytes per second
+	PacingRate() float64
+}
+
+var congestionControls = map[string]func(mss int) CongestionControl{
+	"newreno": func(mss int) CongestionControl { return NewNewReno(mss) },
+	"cubic":   func(mss int) CongestionControl { return NewCubic(mss) },
+	"bbr":     func(mss int) CongestionControl { return NewBBR(mss) },
+}
+
+const defaultCongestionControl = "newreno"
+
+func NewCongestionControl(name string, mss int) (CongestionControl, error) {
+	constructor, ok := congestionControls[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown congestion control %q", name)
+	}
+	return constructor(mss), nil
+}
+
+// Time source of the algorithms, replaced by the link simulator
+type clock func() time.Time
+
+type clockSetter interface {
+	setClock(now clock)
+}
+
+func initialWindow(mss int) int {
+	return 10 * mss
+}
+
+// NewReno (RFC 5681, RFC 6582)
+type NewReno struct {
+	mss        int
+	cwnd       int
+	ssthresh   int
+	ackedBytes int //Bytes acked since the last increase in congestion avoidance
+}
+
+func NewNewReno(mss int) *NewReno {
+	return &NewReno{
+		mss:      mss,
+		cwnd:     initialWindow(mss),
+		ssthresh: 1 << 30}
+}
+
+func (r *NewReno) OnAck(acked int, rtt time.Duration, inFlight int) {
+	if r.cwnd < r.ssthresh {
+		//Slow start
+		if acked > r.mss {
+			acked = r.mss
+		}
+		r.cwnd += acked
+		return
+	}
+
+	//Congestion avoidance: one MSS per RTT
+	r.ackedBytes += acked
+	if r.ackedBytes >= r.cwnd {
+		r.ackedBytes -= r.cwnd
+		r.cwnd += r.mss
+	}
+}
+
+func (r *NewReno) OnLoss(inFlight int) {
+	r.ssthresh = inFlight / 2
+	if r.ssthresh < 2*r.mss {
+		r.ssthresh = 2 * r.mss
+	}
+	r.cwnd = r.ssthresh
+	r.ackedBytes = 0
+}
+
+func (r *NewReno) OnRTO(inFlight int) {
+	r.OnLoss(inFlight)
+	r.cwnd = r.mss
+}
+
+func (r *NewReno) CongestionWindow() int {
+	return r.cwnd
+}
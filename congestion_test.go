@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+const ccMSS = 1000
+
+// Acknowledges a whole window one segment at a time
+func ackWindow(cc CongestionControl, rtt time.Duration) {
+	for n := cc.CongestionWindow() / ccMSS; n > 0; n-- {
+		cc.OnAck(ccMSS, rtt, cc.CongestionWindow())
+	}
+}
+
+func TestNewRenoSlowStart(t *testing.T) {
+	r := NewNewReno(ccMSS)
+	if r.CongestionWindow() != 10*ccMSS {
+		t.Fatal("initial window", r.CongestionWindow())
+	}
+	ackWindow(r, 0)
+	if r.CongestionWindow() != 20*ccMSS {
+		t.Fatal("window", r.CongestionWindow(), "after one round, want", 20*ccMSS)
+	}
+	//A stretch ACK counts as one segment
+	r.OnAck(3*ccMSS, 0, r.CongestionWindow())
+	if r.CongestionWindow() != 21*ccMSS {
+		t.Fatal("window", r.CongestionWindow(), "after a stretch ACK, want", 21*ccMSS)
+	}
+}
+
+func TestNewRenoCongestionAvoidance(t *testing.T) {
+	r := NewNewReno(ccMSS)
+	r.OnLoss(40 * ccMSS)
+	if r.ssthresh != 20*ccMSS || r.CongestionWindow() != 20*ccMSS {
+		t.Fatal("after loss ssthresh", r.ssthresh, "window", r.CongestionWindow())
+	}
+
+	//One segment per round
+	for want := 21; want <= 25; want++ {
+		ackWindow(r, 0)
+		if r.CongestionWindow() != want*ccMSS {
+			t.Fatal("window", r.CongestionWindow(), "want", want*ccMSS)
+		}
+	}
+
+	r.OnLoss(ccMSS)
+	if r.CongestionWindow() != 2*ccMSS {
+		t.Fatal("window", r.CongestionWindow(), "below 2 segments")
+	}
+}
+
+func TestNewRenoRTO(t *testing.T) {
+	r := NewNewReno(ccMSS)
+	r.OnRTO(16 * ccMSS)
+	if r.ssthresh != 8*ccMSS || r.CongestionWindow() != ccMSS {
+		t.Fatal("after RTO ssthresh", r.ssthresh, "window", r.CongestionWindow())
+	}
+	//Slow start up to ssthresh
+	for _, want := range []int{2, 4, 8, 9} {
+		ackWindow(r, 0)
+		if r.CongestionWindow() != want*ccMSS {
+			t.Fatal("window", r.CongestionWindow(), "want", want*ccMSS)
+		}
+	}
+}
+
+// Connection with ten segments in flight from 1000, the send path is driven
+// by hand
+func recoveringConn(t *testing.T) *TeaCPConn {
+	conn := &TeaCPConn{
+		mss:          ccMSS,
+		remoteWindow: 1 << 20,
+		cc:           NewNewReno(ccMSS),
+		rtt:          newRTTEstimator(),
+		sendCond:     sync.NewCond(new(sync.Mutex))}
+	conn.lastReceivedAck = 1000
+	conn.scoreboard.reset(1000)
+	for seq := uint32(1000); seq < 1000+10*ccMSS; seq += ccMSS {
+		conn.ackWaitingBuffer = append(conn.ackWaitingBuffer, &TCPPacket{SeqNum: seq, Data: make([]byte, ccMSS)})
+	}
+	conn.localSeqNumber = 1000 + 10*ccMSS
+	conn.scoreboard.highData = conn.localSeqNumber
+	t.Cleanup(func() {
+		conn.sendCond.L.Lock()
+		conn.stopRTOTimer()
+		conn.sendCond.L.Unlock()
+	})
+	return conn
+}
+
+func ackSegment(ack uint32) *TCPPacket {
+	p := &TCPPacket{AckNum: ack, WindowSize: 65535, DataOffset: 5}
+	p.SetFlag(FlagACK)
+	return p
+}
+
+// Segments 1000 and 6000 are lost (RFC 6582)
+func TestNewRenoPartialACK(t *testing.T) {
+	conn := recoveringConn(t)
+	conn.sendCond.L.Lock()
+	defer conn.sendCond.L.Unlock()
+
+	for i := 0; i < dupThresh; i++ {
+		conn.processAck(ackSegment(1000))
+	}
+	if !conn.scoreboard.inRecovery || conn.cc.CongestionWindow() != 5*ccMSS {
+		t.Fatal("recovery", conn.scoreboard.inRecovery, "window", conn.cc.CongestionWindow())
+	}
+	if p := conn.nextRetransmission(); p == nil || p.SeqNum != 1000 {
+		t.Fatal("fast retransmit", p)
+	}
+	if pipe := conn.pipe(); pipe != 7*ccMSS {
+		t.Fatal("pipe", pipe, "after 3 duplicate ACKs, want", 7*ccMSS)
+	}
+
+	//Partial ACK: the next hole is retransmitted at once, the window is kept
+	conn.processAck(ackSegment(6000))
+	if !conn.scoreboard.inRecovery {
+		t.Fatal("recovery ended by a partial ACK")
+	}
+	if conn.cc.CongestionWindow() != 5*ccMSS {
+		t.Fatal("window", conn.cc.CongestionWindow(), "changed by a partial ACK")
+	}
+	if p := conn.nextRetransmission(); p == nil || p.SeqNum != 6000 {
+		t.Fatal("retransmission after the partial ACK", p)
+	}
+
+	//Full ACK
+	conn.processAck(ackSegment(conn.localSeqNumber))
+	if conn.scoreboard.inRecovery || conn.fastRetransmit {
+		t.Fatal("still recovering after a full ACK")
+	}
+	if conn.cc.CongestionWindow() != 6*ccMSS {
+		t.Fatal("window", conn.cc.CongestionWindow(), "after recovery, want", 6*ccMSS)
+	}
+}
+
+// CUBIC on a synthetic clock
+func testCubic() (*Cubic, *time.Time) {
+	now := time.Unix(1000, 0)
+	c := NewCubic(ccMSS)
+	c.setClock(func() time.Time { return now })
+	return c, &now
+}
+
+// Rounds of one RTT, the clock advanced after each
+func cubicRounds(c *Cubic, now *time.Time, rtt time.Duration, rounds int) {
+	for i := 0; i < rounds; i++ {
+		ackWindow(c, rtt)
+		*now = now.Add(rtt)
+	}
+}
+
+func wCubic(c *Cubic, t float64) float64 {
+	return cubicC*math.Pow(t-c.k, 3) + c.wMax
+}
+
+func TestCubicSlowStart(t *testing.T) {
+	c, now := testCubic()
+	cubicRounds(c, now, 100*time.Millisecond, 2)
+	if c.CongestionWindow() != 40*ccMSS {
+		t.Fatal("window", c.CongestionWindow(), "after two rounds, want", 40*ccMSS)
+	}
+	c.OnAck(3*ccMSS, 0, c.CongestionWindow())
+	if c.CongestionWindow() != 41*ccMSS {
+		t.Fatal("window", c.CongestionWindow(), "after a stretch ACK, want", 41*ccMSS)
+	}
+}
+
+func TestCubicConcaveAndConvex(t *testing.T) {
+	const rtt = 100 * time.Millisecond
+	c, now := testCubic()
+	c.cwnd = 100
+	c.OnLoss(100 * ccMSS)
+	if c.wMax != 100 || c.CongestionWindow() != 70*ccMSS || c.ssthresh != 70 {
+		t.Fatal("after loss W_max", c.wMax, "window", c.CongestionWindow(), "ssthresh", c.ssthresh)
+	}
+
+	start := *now
+	cubicRounds(c, now, rtt, 1)
+	if k := math.Cbrt(30 / cubicC); math.Abs(c.k-k) > 1e-9 {
+		t.Fatal("K", c.k, "want", k)
+	}
+
+	//Concave region: up to W_max at K
+	for now.Sub(start).Seconds() < c.k {
+		cubicRounds(c, now, rtt, 1)
+		elapsed := now.Sub(start).Seconds()
+		if w := float64(c.CongestionWindow()) / ccMSS; w > wCubic(c, elapsed+rtt.Seconds())+1 || w > c.wMax+1 {
+			t.Fatalf("window %.2f above W_cubic %.2f at %.1fs", w, wCubic(c, elapsed+rtt.Seconds()), elapsed)
+		}
+	}
+	if w := float64(c.CongestionWindow()) / ccMSS; w < 0.95*c.wMax {
+		t.Fatalf("window %.2f at K, W_max %.0f", w, c.wMax)
+	}
+
+	//Convex region: probing above W_max
+	cubicRounds(c, now, rtt, 30)
+	elapsed := now.Sub(start).Seconds()
+	if w := float64(c.CongestionWindow()) / ccMSS; w <= c.wMax+1 || w > wCubic(c, elapsed+rtt.Seconds())+1 {
+		t.Fatalf("window %.2f at %.1fs, W_cubic %.2f", w, elapsed, wCubic(c, elapsed+rtt.Seconds()))
+	}
+}
+
+func TestCubicFastConvergence(t *testing.T) {
+	c, _ := testCubic()
+	c.cwnd = 100
+	c.OnLoss(100 * ccMSS)
+	c.OnLoss(70 * ccMSS)
+	if math.Abs(c.wMax-70*(1+cubicBeta)/2) > 1e-9 || math.Abs(c.cwnd-49) > 1e-9 {
+		t.Fatal("W_max", c.wMax, "window", c.cwnd)
+	}
+}
+
+// With a short RTT Reno grows faster than the cubic function, CUBIC follows
+// it (RFC 9438 4.3)
+func TestCubicRenoFriendly(t *testing.T) {
+	const rtt = 5 * time.Millisecond
+	c, now := testCubic()
+	c.cwnd = 10
+	c.OnLoss(10 * ccMSS)
+
+	start := *now
+	cubicRounds(c, now, rtt, 100)
+	elapsed := now.Sub(start).Seconds()
+	w := float64(c.CongestionWindow()) / ccMSS
+	if cubic := wCubic(c, elapsed+rtt.Seconds()); w < cubic+10 {
+		t.Fatalf("window %.2f, W_cubic %.2f", w, cubic)
+	}
+	//W_est grows by 3(1-beta)/(1+beta) segments per RTT
+	reno := 7 + 100*3*(1-cubicBeta)/(1+cubicBeta)
+	if math.Abs(w-reno) > 2 {
+		t.Fatalf("window %.2f, W_est %.2f", w, reno)
+	}
+}
+
+func TestCubicRTO(t *testing.T) {
+	c, _ := testCubic()
+	c.cwnd = 40
+	c.OnRTO(40 * ccMSS)
+	if c.CongestionWindow() != ccMSS || c.ssthresh != 28 {
+		t.Fatal("after RTO window", c.CongestionWindow(), "ssthresh", c.ssthresh)
+	}
+}
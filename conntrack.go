@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State of a tracked TCP connection as seen from the IP layer
+type ConntrackState int
+
+const (
+	ConntrackNone        ConntrackState = iota //UDP and ICMP flows
+	ConntrackSynSent                           //SYN seen
+	ConntrackSynRecv                           //SYN+ACK seen
+	ConntrackEstablished                       //Handshake completed, or picked up in the middle
+	ConntrackFinWait                           //FIN seen in one direction at least
+	ConntrackTimeWait                          //FINs of both directions acknowledged
+	ConntrackClose                             //RST seen
+)
+
+func (s ConntrackState) String() string {
+	switch s {
+	case ConntrackSynSent:
+		return "SYN_SENT"
+	case ConntrackSynRecv:
+		return "SYN_RECV"
+	case ConntrackEstablished:
+		return "ESTABLISHED"
+	case ConntrackFinWait:
+		return "FIN_WAIT"
+	case ConntrackTimeWait:
+		return "TIME_WAIT"
+	case ConntrackClose:
+		return "CLOSE"
+	}
+	return "NONE"
+}
+
+// Idle time after which a flow is forgotten, by state
+type ConntrackTimeouts struct {
+	TCPSynSent     time.Duration
+	TCPSynRecv     time.Duration
+	TCPEstablished time.Duration
+	TCPFinWait     time.Duration
+	TCPTimeWait    time.Duration
+	TCPClose       time.Duration
+	UDP            time.Duration
+	ICMP           time.Duration
+}
+
+// TCP values of RFC 5382 (transitory and established), RFC 4787 for UDP and
+// RFC 5508 for ICMP
+var DefaultConntrackTimeouts = ConntrackTimeouts{
+	TCPSynSent:     4 * time.Minute,
+	TCPSynRecv:     4 * time.Minute,
+	TCPEstablished: 2*time.Hour + 4*time.Minute,
+	TCPFinWait:     4 * time.Minute,
+	TCPTimeWait:    2 * time.Minute,
+	TCPClose:       10 * time.Second,
+	UDP:            5 * time.Minute,
+	ICMP:           time.Minute}
+
+// Largest ACK window accepted below the highest sequence sent, as Linux
+const maxAckWindow = 66000
+
+// Addresses and ports of a packet, the ICMP echo identifier is used as both
+// ports
+type conntrackTuple struct {
+	protocol uint8
+	src      uint32
+	dst      uint32
+	srcPort  uint16
+	dstPort  uint16
+}
+
+func (t conntrackTuple) reverse() conntrackTuple {
+	return conntrackTuple{t.protocol, t.dst, t.src, t.dstPort, t.srcPort}
+}
+
+// Sequence space of one direction of a TCP connection (van Rooij, "Real
+// Stateful TCP Packet Filtering in IP Filter")
+type tcpWindow struct {
+	end      uint32 //Highest sequence sent, plus one
+	maxEnd   uint32 //Highest sequence the peer allowed to send, ack + window
+	maxWin   uint32 //Largest window advertised
+	scale    uint8
+	scaleSet bool //Window scale option sent in the SYN
+	fin      bool
+	finEnd   uint32 //Sequence after the FIN
+	finAcked bool
+}
+
+type conntrackEntry struct {
+	orig    conntrackTuple
+	reply   conntrackTuple //Expected from the peer, differs from orig.reverse() if translated
+	state   ConntrackState
+	window  [2]tcpWindow //Original and reply directions
+	expires time.Time
+	replied bool
+	liberal bool //Picked up in the middle: the window scale is unknown, out of window segments are accepted
+	packets [2]uint64
+	bytes   [2]uint64
+	invalid uint64
+}
+
+func (e *conntrackEntry) translated() bool {
+	return e.reply != e.orig.reverse()
+}
+
+type conntrackKey struct {
+	entry *conntrackEntry
+	reply bool
+}
+
+// Connection tracking table of the flows forwarded by a Router, shared
+// with its NAT
+type Conntrack struct {
+	Timeouts ConntrackTimeouts
+
+	mu        sync.Mutex
+	entries   map[conntrackTuple]conntrackKey //Both directions of each flow
+	lastSweep time.Time
+}
+
+func NewConntrack() *Conntrack {
+	return &Conntrack{
+		Timeouts: DefaultConntrackTimeouts,
+		entries:  make(map[conntrackTuple]conntrackKey)}
+}
+
+// Addresses and ports of a TCP, UDP or ICMP echo packet, false for other
+// packets and for the fragments without the transport header
+func parseConntrackTuple(packet []byte) (conntrackTuple, bool) {
+	headerLen := int(packet[0]&0xf) * 4
+	if binary.BigEndian.Uint16(packet[6:])&ipFragOffsetMask != 0 {
+		return conntrackTuple{}, false
+	}
+	t := conntrackTuple{
+		protocol: packet[9],
+		src:      binary.BigEndian.Uint32(packet[12:]),
+		dst:      binary.BigEndian.Uint32(packet[16:])}
+	l4 := packet[headerLen:]
+
+	switch t.protocol {
+	case ProtocolTCP, ProtocolUDP:
+		if len(l4) < 4 {
+			return conntrackTuple{}, false
+		}
+		t.srcPort = binary.BigEndian.Uint16(l4)
+		t.dstPort = binary.BigEndian.Uint16(l4[2:])
+	case ProtocolICMP:
+		if len(l4) < 8 || (l4[0] != ICMPTypeEcho && l4[0] != ICMPTypeEchoReply) {
+			return conntrackTuple{}, false
+		}
+		t.srcPort = binary.BigEndian.Uint16(l4[4:])
+		t.dstPort = t.srcPort
+	default:
+		return conntrackTuple{}, false
+	}
+	return t, true
+}
+
+// Tracks a packet forwarded without NAT. Returns false for a TCP segment
+// outside the window of its connection, the decision to drop it is left to
+// the caller.
+func (c *Conntrack) Track(packet []byte) bool {
+	tuple, ok := parseConntrackTuple(packet)
+	if !ok {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.sweep(now)
+
+	entry, reply := c.lookup(tuple)
+	if entry == nil {
+		entry = &conntrackEntry{orig: tuple, reply: tuple.reverse()}
+		c.insert(entry)
+	}
+	return c.update(entry, reply, packet, now)
+}
+
+// Must be called with mu held
+func (c *Conntrack) lookup(tuple conntrackTuple) (*conntrackEntry, bool) {
+	key, ok := c.entries[tuple]
+	if !ok {
+		return nil, false
+	}
+	return key.entry, key.reply
+}
+
+// Must be called with mu held
+func (c *Conntrack) insert(entry *conntrackEntry) {
+	c.entries[entry.orig] = conntrackKey{entry, false}
+	c.entries[entry.reply] = conntrackKey{entry, true}
+}
+
+// Must be called with mu held
+func (c *Conntrack) used(tuple conntrackTuple) bool {
+	_, ok := c.entries[tuple]
+	return ok
+}
+
+// Forgets the expired flows, once per second. Must be called with mu held
+func (c *Conntrack) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Second {
+		return
+	}
+	c.lastSweep = now
+	for tuple, key := range c.entries {
+		if now.After(key.entry.expires) {
+			delete(c.entries, tuple)
+		}
+	}
+}
+
+// Updates the counters, state and expiry of a flow from one of its packets.
+// Returns false for a TCP segment outside the window, which leaves the
+// state unchanged. Must be called with mu held
+func (c *Conntrack) update(entry *conntrackEntry, reply bool, packet []byte, now time.Time) bool {
+	dir := 0
+	if reply {
+		dir = 1
+		entry.replied = true
+	}
+	entry.packets[dir]++
+	entry.bytes[dir] += uint64(len(packet))
+
+	timeout := c.Timeouts.UDP
+	switch entry.orig.protocol {
+	case ProtocolICMP:
+		timeout = c.Timeouts.ICMP
+	case ProtocolTCP:
+		headerLen := int(packet[0]&0xf) * 4
+		if !entry.trackTCP(dir, packet[headerLen:]) {
+			entry.invalid++
+			return false
+		}
+		timeout = c.Timeouts.tcp(entry.state)
+	}
+	entry.expires = now.Add(timeout)
+	return true
+}
+
+func (t *ConntrackTimeouts) tcp(state ConntrackState) time.Duration {
+	switch state {
+	case ConntrackSynSent:
+		return t.TCPSynSent
+	case ConntrackSynRecv:
+		return t.TCPSynRecv
+	case ConntrackFinWait:
+		return t.TCPFinWait
+	case ConntrackTimeWait:
+		return t.TCPTimeWait
+	case ConntrackClose:
+		return t.TCPClose
+	}
+	return t.TCPEstablished
+}
+
+// TCP state machine, false if the segment is outside the window
+func (e *conntrackEntry) trackTCP(dir int, segment []byte) bool {
+	if len(segment) < 20 {
+		return false
+	}
+	flags := segment[tcpFlagsOffset]
+	syn := flags&(1<<FlagSYN) != 0
+	ack := flags&(1<<FlagACK) != 0
+
+	//New connection reusing the tuple of a closed one
+	if dir == 0 && syn && !ack && (e.state == ConntrackTimeWait || e.state == ConntrackClose) {
+		e.state = ConntrackNone
+		e.window = [2]tcpWindow{}
+		e.liberal = false
+	}
+	if e.state == ConntrackNone && !syn {
+		e.liberal = true
+	}
+	//A RST answering a SYN must acknowledge it (RFC 793)
+	if flags&(1<<FlagRST) != 0 && e.state == ConntrackSynSent &&
+		(!ack || binary.BigEndian.Uint32(segment[8:]) != e.window[1-dir].end) {
+		return false
+	}
+	if !e.inWindow(dir, segment) && !e.liberal {
+		return false
+	}
+
+	switch {
+	case flags&(1<<FlagRST) != 0:
+		e.state = ConntrackClose
+	case syn && !ack:
+		if e.state == ConntrackNone {
+			e.state = ConntrackSynSent
+		}
+	case syn && ack:
+		if e.state == ConntrackSynSent || e.state == ConntrackNone {
+			e.state = ConntrackSynRecv
+		}
+	case e.state == ConntrackNone:
+		e.state = ConntrackEstablished //Picked up in the middle
+	case e.state == ConntrackSynRecv && ack:
+		e.state = ConntrackEstablished
+	}
+
+	sender, receiver := &e.window[dir], &e.window[1-dir]
+	if flags&(1<<FlagFIN) != 0 && e.state != ConntrackClose {
+		sender.fin = true
+		sender.finEnd = sender.end
+		if e.state < ConntrackFinWait {
+			e.state = ConntrackFinWait
+		}
+	}
+	if ack && receiver.fin && seqGEQ(binary.BigEndian.Uint32(segment[8:]), receiver.finEnd) {
+		receiver.finAcked = true
+	}
+	if e.window[0].finAcked && e.window[1].finAcked && e.state == ConntrackFinWait {
+		e.state = ConntrackTimeWait
+	}
+	return true
+}
+
+// Checks the segment against the sequence space of both directions and
+// updates them, as the Linux conntrack
+func (e *conntrackEntry) inWindow(dir int, segment []byte) bool {
+	sender, receiver := &e.window[dir], &e.window[1-dir]
+	flags := segment[tcpFlagsOffset]
+	syn := flags&(1<<FlagSYN) != 0
+	hasAck := flags&(1<<FlagACK) != 0
+	seq := binary.BigEndian.Uint32(segment[4:])
+	ack := binary.BigEndian.Uint32(segment[8:])
+	win := uint32(binary.BigEndian.Uint16(segment[14:]))
+	dataOffset := int(segment[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(segment) {
+		return false
+	}
+
+	end := seq + uint32(len(segment)-dataOffset)
+	if syn {
+		end++
+	}
+	if flags&(1<<FlagFIN) != 0 {
+		end++
+	}
+
+	if syn {
+		sender.scale, sender.scaleSet = 0, false
+		for _, option := range parseTCPOptions(segment[20:dataOffset]) {
+			if option.Kind == OptionWindowScale && len(option.Data) == 1 {
+				sender.scale, sender.scaleSet = option.Data[0], true
+				if sender.scale > 14 {
+					sender.scale = 14
+				}
+			}
+		}
+		if hasAck && !(sender.scaleSet && receiver.scaleSet) {
+			//Scaling is only used if both SYNs carry the option
+			sender.scale, receiver.scale = 0, 0
+		}
+	}
+
+	if sender.maxWin == 0 {
+		//First segment of this direction
+		sender.end = end
+		if syn {
+			sender.maxEnd = end
+			sender.maxWin = win //The window of a SYN is never scaled
+		} else {
+			sender.maxWin = win << sender.scale
+			sender.maxEnd = end + sender.maxWin
+		}
+		if sender.maxWin == 0 {
+			sender.maxWin = 1
+		}
+		if syn && !hasAck {
+			return true
+		}
+		if receiver.maxWin == 0 && hasAck {
+			receiver.end, receiver.maxEnd = ack, ack
+		}
+	}
+
+	if !syn {
+		win <<= sender.scale
+	}
+	if !hasAck {
+		ack = receiver.end
+	}
+	ackWindow := sender.maxWin
+	if ackWindow < maxAckWindow {
+		ackWindow = maxAckWindow
+	}
+
+	if !seqLEQ(seq, sender.maxEnd) || !seqGEQ(end, sender.end-receiver.maxWin) ||
+		!seqLEQ(ack, receiver.end) || !seqGEQ(ack, receiver.end-ackWindow) {
+		return false
+	}
+
+	if sender.maxWin < win {
+		sender.maxWin = win
+	}
+	if seqGT(end, sender.end) {
+		sender.end = end
+	}
+	if receiver.maxWin != 0 && seqGT(end, sender.maxEnd) {
+		receiver.maxWin += end - sender.maxEnd
+	}
+	if hasAck && seqGEQ(ack+win, receiver.maxEnd) {
+		receiver.maxEnd = ack + win
+		if win == 0 {
+			receiver.maxEnd++
+		}
+	}
+	return true
+}
+
+// Addresses and ports of one direction of a flow
+type FlowTuple struct {
+	Src     net.IP
+	Dst     net.IP
+	SrcPort uint16 //ICMP echo identifier for ICMP
+	DstPort uint16
+}
+
+func newFlowTuple(t conntrackTuple) FlowTuple {
+	return FlowTuple{
+		Src:     net.ParseIP(DecodeIPV4Addr(t.src)),
+		Dst:     net.ParseIP(DecodeIPV4Addr(t.dst)),
+		SrcPort: t.srcPort,
+		DstPort: t.dstPort}
+}
+
+// Copy of a tracked flow
+type ConntrackFlow struct {
+	Protocol uint8
+	Orig     FlowTuple
+	Reply    FlowTuple //As expected from the peer, translated by the NAT
+	State    ConntrackState
+	Expires  time.Time
+	Replied  bool
+	Packets  [2]uint64 //Original and reply directions
+	Bytes    [2]uint64
+	Invalid  uint64 //TCP segments outside the window
+}
+
+// Translated by the NAT
+func (f *ConntrackFlow) Translated() bool {
+	return !f.Reply.Src.Equal(f.Orig.Dst) || !f.Reply.Dst.Equal(f.Orig.Src) ||
+		f.Reply.SrcPort != f.Orig.DstPort || f.Reply.DstPort != f.Orig.SrcPort
+}
+
+// One line in the format of conntrack -L
+func (f *ConntrackFlow) String() string {
+	name := map[uint8]string{ProtocolTCP: "tcp", ProtocolUDP: "udp", ProtocolICMP: "icmp"}[f.Protocol]
+	line := fmt.Sprintf("%-4s %d %d", name, f.Protocol, int(time.Until(f.Expires).Seconds()))
+	if f.Protocol == ProtocolTCP {
+		line += " " + f.State.String()
+	}
+	for dir, t := range []FlowTuple{f.Orig, f.Reply} {
+		line += fmt.Sprintf(" src=%s dst=%s", t.Src, t.Dst)
+		if f.Protocol == ProtocolICMP {
+			line += fmt.Sprintf(" id=%d", t.SrcPort)
+		} else {
+			line += fmt.Sprintf(" sport=%d dport=%d", t.SrcPort, t.DstPort)
+		}
+		line += fmt.Sprintf(" packets=%d bytes=%d", f.Packets[dir], f.Bytes[dir])
+		if dir == 1 && !f.Replied {
+			line += " [UNREPLIED]"
+		}
+	}
+	if f.Invalid > 0 {
+		line += fmt.Sprintf(" invalid=%d", f.Invalid)
+	}
+	return line
+}
+
+func (e *conntrackEntry) flow() ConntrackFlow {
+	return ConntrackFlow{
+		Protocol: e.orig.protocol,
+		Orig:     newFlowTuple(e.orig),
+		Reply:    newFlowTuple(e.reply),
+		State:    e.state,
+		Expires:  e.expires,
+		Replied:  e.replied,
+		Packets:  e.packets,
+		Bytes:    e.bytes,
+		Invalid:  e.invalid}
+}
+
+// Copies of the tracked flows, not expired, in no particular order
+func (c *Conntrack) Flows() []ConntrackFlow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var flows []ConntrackFlow
+	for _, key := range c.entries {
+		if !key.reply && !now.After(key.entry.expires) {
+			flows = append(flows, key.entry.flow())
+		}
+	}
+	return flows
+}
+
+// Calls fn for each tracked flow until it returns false. The table is not
+// locked while fn runs.
+func (c *Conntrack) Range(fn func(flow ConntrackFlow) bool) {
+	for _, flow := range c.Flows() {
+		if !fn(flow) {
+			return
+		}
+	}
+}
+
+// Tracked flows
+func (c *Conntrack) Len() int {
+	return len(c.Flows())
+}
+
+// Writes the flows to w, one per line, sorted by original source
+func (c *Conntrack) Dump(w io.Writer) error {
+	flows := c.Flows()
+	sort.Slice(flows, func(i, j int) bool {
+		a, b := flows[i].Orig, flows[j].Orig
+		if !a.Src.Equal(b.Src) {
+			return IPV4AddrToInt(a.Src.String()) < IPV4AddrToInt(b.Src.String())
+		}
+		return a.SrcPort < b.SrcPort
+	})
+	for _, flow := range flows {
+		if _, err := fmt.Fprintln(w, flow.String()); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d flows\n", len(flows))
+	return err
+}
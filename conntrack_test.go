@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+)
+
+const (
+	ctFIN = 1 << FlagFIN
+	ctSYN = 1 << FlagSYN
+	ctRST = 1 << FlagRST
+	ctACK = 1 << FlagACK
+)
+
+// Segment of the connection between 10.50.0.1:40000 and 10.50.1.1:80,
+// from the client unless reply
+func ctSegment(reply bool, flags uint8, seq, ack uint32, data string) []byte {
+	p := testPacket{protocol: ProtocolTCP, src: "10.50.0.1", dst: "10.50.1.1", sport: 40000, dport: 80, flags: flags, seq: seq, ack: ack, payload: []byte(data)}
+	if reply {
+		p.src, p.dst, p.sport, p.dport = p.dst, p.src, p.dport, p.sport
+	}
+	return p.build()
+}
+
+type ctStep struct {
+	name  string
+	reply bool
+	flags uint8
+	seq   uint32
+	ack   uint32
+	data  string
+	valid bool
+	state ConntrackState
+}
+
+func runConntrack(t *testing.T, ct *Conntrack, steps []ctStep) {
+	t.Helper()
+	for _, step := range steps {
+		if valid := ct.Track(ctSegment(step.reply, step.flags, step.seq, step.ack, step.data)); valid != step.valid {
+			t.Fatalf("%s: valid %v, want %v", step.name, valid, step.valid)
+		}
+		flows := ct.Flows()
+		if len(flows) != 1 {
+			t.Fatalf("%s: %d flows", step.name, len(flows))
+		}
+		if flows[0].State != step.state {
+			t.Fatalf("%s: state %v, want %v", step.name, flows[0].State, step.state)
+		}
+	}
+}
+
+// Handshake and close of a connection, client ISN 1000 and server ISN 5000
+var ctLifecycle = []ctStep{
+	{"SYN", false, ctSYN, 1000, 0, "", true, ConntrackSynSent},
+	{"SYN+ACK", true, ctSYN | ctACK, 5000, 1001, "", true, ConntrackSynRecv},
+	{"ACK", false, ctACK, 1001, 5001, "", true, ConntrackEstablished},
+	{"data", false, ctACK, 1001, 5001, "hello", true, ConntrackEstablished},
+	{"data ACK", true, ctACK, 5001, 1006, "", true, ConntrackEstablished},
+	{"client FIN", false, ctFIN | ctACK, 1006, 5001, "", true, ConntrackFinWait},
+	{"FIN ACK", true, ctACK, 5001, 1007, "", true, ConntrackFinWait},
+	{"server FIN", true, ctFIN | ctACK, 5001, 1007, "", true, ConntrackFinWait},
+	{"last ACK", false, ctACK, 1007, 5002, "", true, ConntrackTimeWait},
+}
+
+func TestConntrackLifecycle(t *testing.T) {
+	runConntrack(t, NewConntrack(), ctLifecycle)
+}
+
+func TestConntrackReset(t *testing.T) {
+	established := ctLifecycle[:5]
+	for _, c := range []struct {
+		name  string
+		reset ctStep
+	}{
+		{"in window", ctStep{"RST", true, ctRST, 5001, 0, "", true, ConntrackClose}},
+		{"in window, after the next sequence", ctStep{"RST", false, ctRST | ctACK, 1500, 5001, "", true, ConntrackClose}},
+		{"out of window", ctStep{"RST", true, ctRST, 5001 + 1<<30, 0, "", false, ConntrackEstablished}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ct := NewConntrack()
+			runConntrack(t, ct, append(append([]ctStep{}, established...), c.reset))
+			if invalid := ct.Flows()[0].Invalid; (invalid == 0) != c.reset.valid {
+				t.Error(invalid, "invalid segments")
+			}
+		})
+	}
+}
+
+// A RST answering a SYN must acknowledge it (RFC 793)
+func TestConntrackResetOfSYN(t *testing.T) {
+	runConntrack(t, NewConntrack(), []ctStep{
+		{"SYN", false, ctSYN, 1000, 0, "", true, ConntrackSynSent},
+		{"RST without ACK", true, ctRST, 0, 0, "", false, ConntrackSynSent},
+		{"RST with another ACK", true, ctRST | ctACK, 0, 2000, "", false, ConntrackSynSent},
+		{"RST", true, ctRST | ctACK, 0, 1001, "", true, ConntrackClose},
+	})
+}
+
+func TestConntrackOutOfWindow(t *testing.T) {
+	ct := NewConntrack()
+	runConntrack(t, ct, append(append([]ctStep{}, ctLifecycle[:5]...),
+		ctStep{"beyond the window", false, ctACK, 1006 + 1<<20, 5001, "late", false, ConntrackEstablished},
+		ctStep{"far below", false, ctACK, 1006 + 3<<30, 5001, "old", false, ConntrackEstablished},
+		ctStep{"ACK of unsent data", false, ctACK, 1006, 9000, "", false, ConntrackEstablished},
+		ctStep{"retransmission", false, ctACK, 1001, 5001, "hello", true, ConntrackEstablished},
+		ctStep{"next segment", false, ctACK, 1006, 5001, "world", true, ConntrackEstablished}))
+	if invalid := ct.Flows()[0].Invalid; invalid != 3 {
+		t.Error(invalid, "invalid segments, want 3")
+	}
+}
+
+// A flow seen first in the middle is established and tracked liberally,
+// its window scale is unknown
+func TestConntrackMidStream(t *testing.T) {
+	ct := NewConntrack()
+	runConntrack(t, ct, []ctStep{
+		{"data", false, ctACK, 70000, 90000, "middle", true, ConntrackEstablished},
+		{"answer", true, ctACK, 90000, 70006, "reply", true, ConntrackEstablished},
+		{"far ahead, window scaled", false, ctACK, 70006 + 1<<24, 90005, "data", true, ConntrackEstablished},
+		{"FIN", true, ctFIN | ctACK, 90005, 70006, "", true, ConntrackFinWait},
+	})
+	if invalid := ct.Flows()[0].Invalid; invalid != 0 {
+		t.Error(invalid, "invalid segments")
+	}
+}
+
+// A new SYN on the tuple of a closed connection starts a new one
+func TestConntrackTupleReuse(t *testing.T) {
+	ct := NewConntrack()
+	runConntrack(t, ct, append(append([]ctStep{}, ctLifecycle...),
+		ctStep{"new SYN", false, ctSYN, 800000, 0, "", true, ConntrackSynSent},
+		ctStep{"new SYN+ACK", true, ctSYN | ctACK, 900000, 800001, "", true, ConntrackSynRecv},
+		ctStep{"new ACK", false, ctACK, 800001, 900001, "", true, ConntrackEstablished},
+		ctStep{"old segment", false, ctACK, 1007, 5002, "", false, ConntrackEstablished}))
+
+	//Same after a reset
+	ct = NewConntrack()
+	runConntrack(t, ct, append(append([]ctStep{}, ctLifecycle[:5]...),
+		ctStep{"RST", true, ctRST, 5001, 0, "", true, ConntrackClose},
+		ctStep{"new SYN", false, ctSYN, 800000, 0, "", true, ConntrackSynSent}))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// CUBIC (RFC 9438). Windows are computed in segments.
+type Cubic struct {
+	mss      int
+	cwnd     float64
+	ssthresh float64
+
+	wMax       float64
+	k          float64
+	wEst       float64
+	epochStart time.Time
+	minRTT     time.Duration
+
+	now clock
+}
+
+func NewCubic(mss int) *Cubic {
+	return &Cubic{
+		mss:      mss,
+		cwnd:     float64(initialWindow(mss)) / float64(mss),
+		ssthresh: math.MaxFloat64,
+		now:      time.Now}
+}
+
+func (c *Cubic) setClock(now clock) {
+	c.now = now
+}
+
+func (c *Cubic) OnAck(acked int, rtt time.Duration, inFlight int) {
+	if rtt > 0 && (c.minRTT == 0 || rtt < c.minRTT) {
+		c.minRTT = rtt
+	}
+	segments := float64(acked) / float64(c.mss)
+
+	if c.cwnd < c.ssthresh {
+		//Slow start
+		c.cwnd += math.Min(segments, 1)
+		return
+	}
+
+	now := c.now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wMax = c.cwnd
+		}
+		c.wEst = c.cwnd
+	}
+
+	t := (now.Sub(c.epochStart) + c.minRTT).Seconds()
+	target := cubicC*math.Pow(t-c.k, 3) + c.wMax
+	if target > 1.5*c.cwnd {
+		target = 1.5 * c.cwnd
+	}
+
+	//Reno-friendly region
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * segments / c.cwnd
+	if c.wEst > target {
+		target = c.wEst
+	}
+
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd * segments
+	}
+}
+
+func (c *Cubic) OnLoss(inFlight int) {
+	c.epochStart = time.Time{}
+
+	//Fast convergence
+	if c.cwnd < c.wMax {
+		c.wMax = c.cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+
+	c.ssthresh = math.Max(c.cwnd*cubicBeta, 2)
+	c.cwnd = c.ssthresh
+}
+
+func (c *Cubic) OnRTO(inFlight int) {
+	c.OnLoss(inFlight)
+	c.cwnd = 1
+}
+
+func (c *Cubic) CongestionWindow() int {
+	return int(c.cwnd * float64(c.mss))
+}
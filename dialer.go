@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Options applied to the connections of a Dialer
+type Dialer struct {
+	LocalAddr *net.IPAddr   //Source address of the route if nil
+	Timeout   time.Duration //Handshake timeout, none if zero
+	KeepAlive time.Duration //Keep-alive period, 15s if zero. A negative value disables them
+
+	NoDelay           bool
+	CongestionControl string        //"newreno" if empty
+	MaxPacingRate     float64       //Bytes per second, 0 for no cap
+	DelayedAck        time.Duration //0 keeps the default
+	UserTimeout       time.Duration //Advertised to the peer, none if zero
+	ECN               ECNMode       //Classic ECN if zero
+	Link              LinkOpener    //Interface of the route if nil
+}
+
+func (d *Dialer) Dial(remoteAddr *net.IPAddr, port int) (*TeaCPConn, error) {
+	return d.DialContext(context.Background(), remoteAddr, port)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, remoteAddr *net.IPAddr, port int) (*TeaCPConn, error) {
+	//Checked before the SYN, a peer is never reset for a local mistake
+	if d.CongestionControl != "" {
+		if _, err := NewCongestionControl(d.CongestionControl, defaultMSS); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: "teacp", Source: d.LocalAddr, Addr: remoteAddr, Err: err}
+		}
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	conn, err := dial(ctx, &TeaCPConn{
+		localIPAddr:  d.LocalAddr,
+		remoteIPAddr: remoteAddr,
+		destPort:     uint16(port),
+		ecnMode:      d.ECN,
+		link:         d.Link})
+	if err != nil {
+		return nil, err
+	}
+
+	if d.KeepAlive >= 0 {
+		period := d.KeepAlive
+		if period == 0 {
+			period = defaultKeepAliveIdle
+		}
+		conn.SetKeepAlivePeriod(period)
+		conn.SetKeepAlive(true)
+	}
+	conn.SetNoDelay(d.NoDelay)
+	if d.CongestionControl != "" {
+		if err := conn.SetCongestionControl(d.CongestionControl); err != nil {
+			conn.Abort()
+			return nil, conn.opError("dial", err)
+		}
+	}
+	if d.MaxPacingRate > 0 {
+		conn.SetMaxPacingRate(d.MaxPacingRate)
+	}
+	if d.DelayedAck > 0 {
+		conn.SetDelayedAck(d.DelayedAck)
+	}
+	if d.UserTimeout > 0 {
+		if err := conn.SetUserTimeout(d.UserTimeout, true); err != nil {
+			conn.Abort()
+			return nil, conn.opError("dial", err)
+		}
+	}
+	return conn, nil
+}
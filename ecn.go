@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ECN field of the IP header (RFC 3168)
+const (
+	ECNNotECT = 0
+	ECNECT1   = 1
+	ECNECT0   = 2
+	ECNCE     = 3
+)
+
+// Implemented by the IP connections that can set and report the ECN field
+type ECNConn interface {
+	WriteECN(b []byte, ecn uint8) (n int, err error)
+	ReadECN(b []byte) (n int, ecn uint8, err error)
+}
+
+type ECNMode int
+
+const (
+	ECNClassic  ECNMode = iota //RFC 3168, the default
+	ECNAccurate                //Accurate ECN, CE marks counted in the ACE field
+	ECNDisabled
+)
+
+const (
+	aceShift     = FlagECE //ACE field: AE (NS), CWR and ECE flags
+	aceMask      = 0x7 << aceShift
+	aceInitCount = 5 //Initial value of the CE packet counters
+)
+
+func (m ECNMode) String() string {
+	switch m {
+	case ECNClassic:
+		return "classic"
+	case ECNAccurate:
+		return "accurate"
+	}
+	return "disabled"
+}
+
+func (packet *TCPPacket) ace() uint8 {
+	return uint8((packet.Flags & aceMask) >> aceShift)
+}
+
+func (packet *TCPPacket) setACE(value uint8) {
+	packet.Flags = packet.Flags&^aceMask | uint16(value&0x7)<<aceShift
+}
+
+// ECN setup flags of our SYN
+func (t *TeaCPConn) ecnSYN(packet *TCPPacket) {
+	switch t.ecnMode {
+	case ECNClassic:
+		packet.SetFlag(FlagECE)
+		packet.SetFlag(FlagCWR)
+	case ECNAccurate:
+		packet.setACE(0x7)
+	}
+}
+
+// Active open: the mode accepted by the SYN+ACK of the peer. Handshake
+// segments are sent Not-ECT, so the ACE of an AccECN SYN+ACK is 0b010.
+func (t *TeaCPConn) ecnSYNACKReceived(synAck *TCPPacket) {
+	mode := ECNDisabled
+	switch synAck.ace() {
+	case 0x1: //ECE only
+		if t.ecnMode != ECNDisabled {
+			mode = ECNClassic
+		}
+	case 0x2, 0x3, 0x4, 0x6:
+		if t.ecnMode == ECNAccurate {
+			mode = ECNAccurate
+		}
+	}
+	t.ecnMode = mode
+	t.initECN()
+}
+
+// Passive open: picks the mode from the SYN of the peer and sets the flags
+// of our SYN+ACK. Accurate ECN is accepted unless ECN is disabled.
+func (t *TeaCPConn) ecnSYNReceived(syn *TCPPacket, synAck *TCPPacket) {
+	mode := ECNDisabled
+	switch syn.ace() {
+	case 0x7:
+		if t.ecnMode != ECNDisabled {
+			mode = ECNAccurate
+			synAck.setACE(0x2) //SYN received Not-ECT
+		}
+	case 0x3:
+		if t.ecnMode != ECNDisabled {
+			mode = ECNClassic
+			synAck.SetFlag(FlagECE)
+		}
+	}
+	t.ecnMode = mode
+	t.initECN()
+}
+
+func (t *TeaCPConn) initECN() {
+	t.rcvCEP = aceInitCount
+	t.sndCEP = aceInitCount
+	if t.ecnMode != ECNDisabled {
+		fmt.Println("ECN negotiated:", t.ecnMode)
+	}
+}
+
+// Sets the ECN feedback flags of an outgoing segment and returns the
+// codepoint of its IP header. Retransmissions are never ECN capable.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) markECN(packet *TCPPacket, retransmission bool) uint8 {
+	switch t.ecnMode {
+	case ECNClassic:
+		packet.ClearFlag(FlagECE)
+		if t.ecnEcho {
+			packet.SetFlag(FlagECE)
+		}
+		if len(packet.Data) > 0 && !retransmission {
+			if t.ecnCWR {
+				packet.SetFlag(FlagCWR) //Window reduced, the peer can stop echoing
+				t.ecnCWR = false
+			}
+			return ECNECT0
+		}
+	case ECNAccurate:
+		packet.setACE(uint8(t.rcvCEP))
+		if len(packet.Data) > 0 && !retransmission {
+			return ECNECT0
+		}
+	}
+	return ECNNotECT
+}
+
+// ECN codepoint and feedback flags of an incoming segment.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) receivedECN(packet *TCPPacket, ecn uint8) {
+	switch t.ecnMode {
+	case ECNClassic:
+		if packet.HasFlag(FlagCWR) && len(packet.Data) > 0 {
+			t.ecnEcho = false
+		}
+		if ecn == ECNCE {
+			fmt.Println("I: CE mark received")
+			t.ecnEcho = true
+			t.ackNow = true
+		}
+		if packet.HasFlag(FlagACK) && packet.HasFlag(FlagECE) && !packet.handshakeACK {
+			t.ecnCongestion()
+		}
+	case ECNAccurate:
+		if ecn == ECNCE {
+			fmt.Println("I: CE mark received")
+			t.rcvCEP++
+			t.ackNow = true
+		}
+		//The ACE of the handshake ACK feeds back the ECN field of the SYN+ACK
+		if packet.HasFlag(FlagACK) && !packet.handshakeACK {
+			delta := (packet.ace() - uint8(t.sndCEP)) & 0x7
+			t.sndCEP += uint32(delta)
+			if delta > 0 {
+				t.ecnCongestion()
+			}
+		}
+	}
+}
+
+// Congestion signaled by the peer: the window is reduced like for a loss, at
+// most once per round trip (RFC 3168 6.1.2).
+// Must be called with sendCond.L held
+func (t *TeaCPConn) ecnCongestion() {
+	if t.ecnReacted && seqLT(t.lastReceivedAck, t.ecnRecover) {
+		return
+	}
+	if t.scoreboard.inRecovery {
+		return //Already reduced for the loss
+	}
+
+	fmt.Println("I: ECN congestion signal, window reduced")
+	t.cc.OnLoss(int(t.localSeqNumber - t.lastReceivedAck))
+	t.ecnReacted = true
+	t.ecnRecover = t.localSeqNumber
+	t.ecnCWR = t.ecnMode == ECNClassic
+	t.updatePacingRate()
+}
+
+func (t *TeaCPConn) writeSegment(b []byte, ecn uint8) (n int, err error) {
+	if t.batching {
+		t.batch = append(t.batch, Segment{b, ecn})
+		return len(b), nil
+	}
+	if conn, ok := t.ipConn.(ECNConn); ok && ecn != ECNNotECT {
+		return conn.WriteECN(b, ecn)
+	}
+	return t.ipConn.Write(b)
+}
+
+func (t *TeaCPConn) readSegment(segment *Segment) error {
+	b := segment.Data[:cap(segment.Data)]
+	var n int
+	var err error
+	segment.ECN = ECNNotECT
+	if conn, ok := t.ipConn.(ECNConn); ok {
+		n, segment.ECN, err = conn.ReadECN(b)
+	} else {
+		n, err = t.ipConn.Read(b)
+	}
+	if err != nil {
+		return err
+	}
+	segment.Data = b[:n]
+	return nil
+}
+
+// Mode negotiated during the handshake
+func (t *TeaCPConn) ECN() ECNMode {
+	return t.ecnMode
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// The client side is driven by hand over the loopback interface so that the
+// ACK completing the handshake carries data
+func TestAccECNHandshakeACKWithData(t *testing.T) {
+	serverAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	clientAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	listener, err := ListenLink(OpenLoopback, serverAddr, 7039)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := OpenLoopback(clientAddr, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	bindPorts(client, 40039, 7039)
+
+	syn := &TCPPacket{SrcPort: 40039, DestPort: 7039, SeqNum: 1000, DataOffset: 5, WindowSize: 65535}
+	syn.SetFlag(FlagSYN)
+	syn.setACE(0x7)
+	if _, err := client.Write(syn.Marshall(clientAddr.IP.String(), serverAddr.IP.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	setReadDeadline(client, time.Now().Add(2*time.Second))
+	b := make([]byte, 65535)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synAck := NewTCPPacket(b[:n])
+	if !synAck.HasFlag(FlagSYN) || !synAck.HasFlag(FlagACK) || synAck.AckNum != 1001 {
+		t.Fatal("no SYN+ACK:", synAck)
+	}
+	if synAck.ace() != 0x2 {
+		t.Fatalf("SYN+ACK ACE %#x, want 0x2 (AccECN, SYN received Not-ECT)", synAck.ace())
+	}
+
+	//Handshake ACK feeding back the Not-ECT SYN+ACK, with data
+	ack := &TCPPacket{SrcPort: 40039, DestPort: 7039, SeqNum: 1001, AckNum: synAck.SeqNum + 1, DataOffset: 5, WindowSize: 65535, Data: []byte("hello")}
+	ack.SetFlag(FlagACK)
+	ack.setACE(0x2)
+	if _, err := client.Write(ack.Marshall(clientAddr.IP.String(), serverAddr.IP.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := listener.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Abort()
+	if conn.ECN() != ECNAccurate {
+		t.Fatal("negotiated", conn.ECN())
+	}
+
+	n, err = conn.Read(b)
+	if err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("read %q, %v", b[:n], err)
+	}
+
+	conn.sendCond.L.Lock()
+	defer conn.sendCond.L.Unlock()
+	if conn.sndCEP != aceInitCount {
+		t.Errorf("CE marks reported by the peer %d, want %d", conn.sndCEP, aceInitCount)
+	}
+	if conn.ecnReacted {
+		t.Error("congestion response to the handshake ACK")
+	}
+}
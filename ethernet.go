@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+)
+
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeARP  = 0x0806
+
+	ethernetHeaderLen = 14
+	ethernetMinLen    = 60 //Without the FCS
+)
+
+var ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Ethernet II frame, without the FCS
+type EthernetFrame struct {
+	Dst       net.HardwareAddr
+	Src       net.HardwareAddr
+	EtherType uint16
+	Payload   []byte
+}
+
+func NewEthernetFrame(data []byte) (*EthernetFrame, error) {
+	if len(data) < ethernetHeaderLen {
+		return nil, fmt.Errorf("Ethernet frame too short: %d bytes", len(data))
+	}
+	return &EthernetFrame{
+		Dst:       net.HardwareAddr(data[0:6]),
+		Src:       net.HardwareAddr(data[6:12]),
+		EtherType: binary.BigEndian.Uint16(data[12:14]),
+		Payload:   data[ethernetHeaderLen:]}, nil
+}
+
+func (f *EthernetFrame) Marshall() []byte {
+	length := ethernetHeaderLen + len(f.Payload)
+	if length < ethernetMinLen {
+		length = ethernetMinLen //Padded with zeros
+	}
+	output := make([]byte, length)
+	copy(output[0:6], f.Dst)
+	copy(output[6:12], f.Src)
+	binary.BigEndian.PutUint16(output[12:14], f.EtherType)
+	copy(output[ethernetHeaderLen:], f.Payload)
+	return output
+}
+
+// Random locally administered unicast address
+func randomHardwareAddr() net.HardwareAddr {
+	addr := make(net.HardwareAddr, 6)
+	for i := range addr {
+		addr[i] = byte(rand.Int())
+	}
+	addr[0] = addr[0]&^0x01 | 0x02
+	return addr
+}
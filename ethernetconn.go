@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPConn over an Ethernet device (TAP or AF_PACKET socket): IP packets are
+// carried in Ethernet II frames and the hardware address of the destination
+// is resolved with ARP.
+type EthernetIPConn struct {
+	device       io.ReadWriteCloser
+	hardwareAddr net.HardwareAddr
+	localAddr    *net.IPAddr
+	remoteAddr   *net.IPAddr
+	srcField     uint32
+	dstField     uint32
+	neighbors    *neighborCache
+
+	in        chan ethernetPacket
+	deadline  readDeadline
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// IP packet addressed to us, or the ICMP error it carries
+type ethernetPacket struct {
+	packet *IPV4Packet
+	err    error
+}
+
+// Opens the TAP device name for each connection. A random locally
+// administered address is used if hardwareAddr is nil.
+func TapLink(name string, hardwareAddr net.HardwareAddr) LinkOpener {
+	return func(localAddr, remoteAddr *net.IPAddr) (LinkConn, error) {
+		device, err := openTapDevice(name)
+		if err != nil {
+			return nil, err
+		}
+		addr := hardwareAddr
+		if addr == nil {
+			addr = randomHardwareAddr()
+		}
+		waitForSetup("Try: sudo ip link set " + name + " master br0 up")
+		return NewEthernetIPConn(device, addr, localAddr, remoteAddr), nil
+	}
+}
+
+// remoteAddr can be nil for a listener
+func NewEthernetIPConn(device io.ReadWriteCloser, hardwareAddr net.HardwareAddr, localAddr, remoteAddr *net.IPAddr) *EthernetIPConn {
+	c := &EthernetIPConn{
+		device:       device,
+		hardwareAddr: hardwareAddr,
+		localAddr:    localAddr,
+		remoteAddr:   remoteAddr,
+		srcField:     IPV4AddrToInt(localAddr.IP.String()),
+		in:           make(chan ethernetPacket, 64),
+		closed:       make(chan struct{})}
+	if remoteAddr != nil {
+		c.dstField = IPV4AddrToInt(remoteAddr.IP.String())
+	}
+	c.neighbors = newNeighborCache(c.sendARPRequest, func(mac net.HardwareAddr, packet []byte) {
+		c.writeFrame(mac, EtherTypeIPv4, packet)
+	})
+
+	go c.receiver()
+	return c
+}
+
+func (c *EthernetIPConn) RemoteAddr() net.IPAddr {
+	return *c.remoteAddr
+}
+
+func (c *EthernetIPConn) LocalAddr() net.IPAddr {
+	return *c.localAddr
+}
+
+func (c *EthernetIPConn) HardwareAddr() net.HardwareAddr {
+	return c.hardwareAddr
+}
+
+func (c *EthernetIPConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.neighbors.close()
+		err = c.device.Close()
+	})
+	return err
+}
+
+func (c *EthernetIPConn) receiver() {
+	buffer := make([]byte, 65535+ethernetHeaderLen)
+	for {
+		length, err := c.device.Read(buffer)
+		if err != nil {
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+			fmt.Println("ETH: read error", err)
+			c.Close()
+			return
+		}
+
+		frame, err := NewEthernetFrame(buffer[:length])
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(frame.Dst, c.hardwareAddr) && !bytes.Equal(frame.Dst, ethernetBroadcast) {
+			continue
+		}
+
+		switch frame.EtherType {
+		case EtherTypeARP:
+			c.handleARP(frame)
+		case EtherTypeIPv4:
+			data := append([]byte(nil), frame.Payload...)
+			packet := NewIPV4Packet(data)
+			if !packet.validLength(len(data)) {
+				fmt.Println("ETH: malformed IP packet dropped")
+				continue
+			}
+			if int(packet.Length) < len(data) {
+				packet.Payload = packet.Payload[:int(packet.Length)-int(packet.IHL)*4] //Ethernet padding
+			}
+			ok, err := acceptIPV4Packet(packet, c.srcField)
+			if !ok && err == nil {
+				continue
+			}
+			select {
+			case c.in <- ethernetPacket{packet, err}:
+			default:
+				fmt.Println("ETH: receive queue full, packet dropped")
+			}
+		}
+	}
+}
+
+func (c *EthernetIPConn) handleARP(frame *EthernetFrame) {
+	arp, err := NewARPPacket(frame.Payload)
+	if err != nil || arp.HardwareType != arpHardwareEthernet || arp.ProtocolType != EtherTypeIPv4 {
+		return
+	}
+
+	forUs := arp.TargetIP == c.srcField
+	c.neighbors.update(arp.SenderIP, arp.SenderMAC, forUs)
+	if !forUs || arp.Operation != ARPRequest {
+		return
+	}
+
+	reply := &ARPPacket{
+		HardwareType: arpHardwareEthernet,
+		ProtocolType: EtherTypeIPv4,
+		Operation:    ARPReply,
+		SenderMAC:    c.hardwareAddr,
+		SenderIP:     c.srcField,
+		TargetMAC:    arp.SenderMAC,
+		TargetIP:     arp.SenderIP}
+	c.writeFrame(arp.SenderMAC, EtherTypeARP, reply.Marshall())
+}
+
+func (c *EthernetIPConn) sendARPRequest(ip uint32) {
+	fmt.Println("ARP: who has", DecodeIPV4Addr(ip), "tell", DecodeIPV4Addr(c.srcField))
+	request := &ARPPacket{
+		HardwareType: arpHardwareEthernet,
+		ProtocolType: EtherTypeIPv4,
+		Operation:    ARPRequest,
+		SenderMAC:    c.hardwareAddr,
+		SenderIP:     c.srcField,
+		TargetMAC:    make(net.HardwareAddr, 6),
+		TargetIP:     ip}
+	c.writeFrame(ethernetBroadcast, EtherTypeARP, request.Marshall())
+}
+
+func (c *EthernetIPConn) writeFrame(dst net.HardwareAddr, etherType uint16, payload []byte) (int, error) {
+	frame := &EthernetFrame{Dst: dst, Src: c.hardwareAddr, EtherType: etherType, Payload: payload}
+	return c.device.Write(frame.Marshall())
+}
+
+func (c *EthernetIPConn) Write(data []byte) (n int, err error) {
+	return c.write(data, c.dstField, ECNNotECT)
+}
+
+func (c *EthernetIPConn) WriteECN(data []byte, ecn uint8) (n int, err error) {
+	return c.write(data, c.dstField, ecn)
+}
+
+func (c *EthernetIPConn) WriteTo(data []byte, addr *net.IPAddr) (n int, err error) {
+	return c.write(data, IPV4AddrToInt(addr.IP.String()), ECNNotECT)
+}
+
+func (c *EthernetIPConn) WriteToECN(data []byte, addr *net.IPAddr, ecn uint8) (n int, err error) {
+	return c.write(data, IPV4AddrToInt(addr.IP.String()), ecn)
+}
+
+// The packet is queued if the destination is not resolved yet
+func (c *EthernetIPConn) write(data []byte, dst uint32, ecn uint8) (n int, err error) {
+	select {
+	case <-c.closed:
+		return -1, net.ErrClosed
+	default:
+	}
+
+	packet := newTCPIPV4Packet(c.srcField, dst, ecn, data).Serialize()
+	mac, ok := c.neighbors.resolve(dst, packet)
+	if !ok {
+		return len(data), nil
+	}
+	if _, err := c.writeFrame(mac, EtherTypeIPv4, packet); err != nil {
+		return -1, err
+	}
+	return len(data), nil
+}
+
+func (c *EthernetIPConn) Read(b []byte) (n int, err error) {
+	n, _, _, err = c.ReadFromECN(b)
+	return n, err
+}
+
+func (c *EthernetIPConn) ReadECN(b []byte) (n int, ecn uint8, err error) {
+	n, _, ecn, err = c.ReadFromECN(b)
+	return n, ecn, err
+}
+
+func (c *EthernetIPConn) ReadFrom(b []byte) (n int, addr *net.IPAddr, err error) {
+	n, addr, _, err = c.ReadFromECN(b)
+	return n, addr, err
+}
+
+// Blocks until a packet is received, the deadline or Close
+func (c *EthernetIPConn) ReadFromECN(b []byte) (n int, addr *net.IPAddr, ecn uint8, err error) {
+	for {
+		timeout, changed, stop, expired := c.deadline.wait()
+		if expired {
+			return -1, nil, 0, ErrReadTimeout
+		}
+
+		select {
+		case p := <-c.in:
+			stop()
+			if p.err != nil {
+				return -1, nil, 0, p.err
+			}
+			addr = &net.IPAddr{IP: net.ParseIP(DecodeIPV4Addr(p.packet.SrcIp))}
+			return copy(b, p.packet.Payload), addr, p.packet.ECN, nil
+		case <-c.closed:
+			stop()
+			return -1, nil, 0, net.ErrClosed
+		case <-timeout:
+			return -1, nil, 0, ErrReadTimeout
+		case <-changed:
+			stop() //New deadline
+		}
+	}
+}
+
+func (c *EthernetIPConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	ethLocal  = &net.IPAddr{IP: net.IPv4(10, 41, 0, 1)}
+	ethRemote = &net.IPAddr{IP: net.IPv4(10, 41, 0, 2)}
+	ethPeer   = net.HardwareAddr{0x02, 0, 0, 0, 0x41, 0x02}
+)
+
+// EthernetIPConn on one end of a pipe, the frames it sends are read from
+// the other end
+func pipeEthernetIPConn(t *testing.T) (*EthernetIPConn, net.Conn, chan *EthernetFrame) {
+	device, peer := net.Pipe()
+	conn := NewEthernetIPConn(device, randomHardwareAddr(), ethLocal, ethRemote)
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+
+	frames := make(chan *EthernetFrame, 64)
+	go func() {
+		for {
+			b := make([]byte, 65535)
+			n, err := peer.Read(b)
+			if err != nil {
+				return
+			}
+			if frame, err := NewEthernetFrame(b[:n]); err == nil {
+				frames <- frame
+			}
+		}
+	}()
+	return conn, peer, frames
+}
+
+func nextFrame(t *testing.T, frames chan *EthernetFrame, etherType uint16) *EthernetFrame {
+	for {
+		select {
+		case frame := <-frames:
+			if frame.EtherType == etherType {
+				return frame
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no frame of type %#x", etherType)
+			return nil
+		}
+	}
+}
+
+func arpFrame(dst net.HardwareAddr, operation uint16, targetMAC net.HardwareAddr) []byte {
+	arp := &ARPPacket{
+		HardwareType: arpHardwareEthernet,
+		ProtocolType: EtherTypeIPv4,
+		Operation:    operation,
+		SenderMAC:    ethPeer,
+		SenderIP:     IPV4AddrToInt(ethRemote.IP.String()),
+		TargetMAC:    targetMAC,
+		TargetIP:     IPV4AddrToInt(ethLocal.IP.String())}
+	frame := &EthernetFrame{Dst: dst, Src: ethPeer, EtherType: EtherTypeARP, Payload: arp.Marshall()}
+	return frame.Marshall()
+}
+
+func ipv4Frame(dst net.HardwareAddr, ip []byte) []byte {
+	frame := &EthernetFrame{Dst: dst, Src: ethPeer, EtherType: EtherTypeIPv4, Payload: ip}
+	return frame.Marshall()
+}
+
+func TestNewIPV4PacketTruncated(t *testing.T) {
+	packet := newTCPIPV4Packet(1, 2, ECNNotECT, make([]byte, 20)).Serialize()
+	packet[0] = 0x4f //IHL 15, 60 bytes of header in a 40 bytes packet
+	p := NewIPV4Packet(packet)
+	if p.validLength(len(packet)) {
+		t.Error("header longer than the packet accepted")
+	}
+	NewIPV4Packet(packet[:10])
+}
+
+// Malformed IP headers are dropped, the receiver keeps running
+func TestEthernetMalformedIPV4(t *testing.T) {
+	conn, peer, _ := pipeEthernetIPConn(t)
+	segment := &TCPPacket{SrcPort: 80, DestPort: 40041, SeqNum: 1, DataOffset: 5, Data: []byte("ok")}
+	valid := newTCPIPV4Packet(IPV4AddrToInt(ethRemote.IP.String()), IPV4AddrToInt(ethLocal.IP.String()), ECNNotECT,
+		segment.Marshall(ethRemote.IP.String(), ethLocal.IP.String())).Serialize()
+
+	for _, corrupt := range []func(b []byte){
+		func(b []byte) { b[2], b[3] = 0, 10 }, //Total length below the header length
+		func(b []byte) { b[0] = 0x44 },        //IHL below 5
+		func(b []byte) { b[0] = 0x4f },        //Header longer than the total length
+		func(b []byte) { b[2], b[3] = 5, 0 },  //Total length beyond the frame
+	} {
+		b := append([]byte(nil), valid...)
+		corrupt(b)
+		if _, err := peer.Write(ipv4Frame(conn.HardwareAddr(), b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := peer.Write(ipv4Frame(conn.HardwareAddr(), valid)); err != nil {
+		t.Fatal(err)
+	}
+
+	setReadDeadline(conn, time.Now().Add(time.Second))
+	b := make([]byte, 100)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := NewTCPPacket(b[:n]); string(got.Data) != "ok" {
+		t.Fatalf("read %q", got.Data)
+	}
+}
+
+func TestEthernetARPReply(t *testing.T) {
+	conn, peer, frames := pipeEthernetIPConn(t)
+	if _, err := peer.Write(arpFrame(ethernetBroadcast, ARPRequest, make(net.HardwareAddr, 6))); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := nextFrame(t, frames, EtherTypeARP)
+	reply, err := NewARPPacket(frame.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame.Dst, ethPeer) || reply.Operation != ARPReply {
+		t.Fatal("not a reply to the requester:", frame.Dst, reply.Operation)
+	}
+	if !bytes.Equal(reply.SenderMAC, conn.HardwareAddr()) || reply.SenderIP != IPV4AddrToInt(ethLocal.IP.String()) {
+		t.Error("reply sender", reply.SenderMAC, DecodeIPV4Addr(reply.SenderIP))
+	}
+	if !bytes.Equal(reply.TargetMAC, ethPeer) || reply.TargetIP != IPV4AddrToInt(ethRemote.IP.String()) {
+		t.Error("reply target", reply.TargetMAC, DecodeIPV4Addr(reply.TargetIP))
+	}
+
+	//The requester was learned, no request is needed to reach it
+	if mac, ok := conn.neighbors.resolve(IPV4AddrToInt(ethRemote.IP.String()), nil); !ok || !bytes.Equal(mac, ethPeer) {
+		t.Error("requester not in the cache:", mac)
+	}
+}
+
+// Segments written before the resolution are sent once the reply arrives
+func TestEthernetPendingUntilResolved(t *testing.T) {
+	conn, peer, frames := pipeEthernetIPConn(t)
+	for _, data := range []string{"one", "two"} {
+		if _, err := conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frame := nextFrame(t, frames, EtherTypeARP)
+	request, err := NewARPPacket(frame.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame.Dst, ethernetBroadcast) || request.Operation != ARPRequest || request.TargetIP != IPV4AddrToInt(ethRemote.IP.String()) {
+		t.Fatal("not a request for the remote address:", frame.Dst, request.Operation, DecodeIPV4Addr(request.TargetIP))
+	}
+	select {
+	case frame := <-frames:
+		t.Fatalf("frame of type %#x sent before the resolution", frame.EtherType)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := peer.Write(arpFrame(conn.HardwareAddr(), ARPReply, conn.HardwareAddr())); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"one", "two"} {
+		frame := nextFrame(t, frames, EtherTypeIPv4)
+		if !bytes.Equal(frame.Dst, ethPeer) {
+			t.Fatal("sent to", frame.Dst)
+		}
+		packet := NewIPV4Packet(frame.Payload)
+		if got := string(packet.Payload[:int(packet.Length)-20]); got != data {
+			t.Fatalf("sent %q, want %q", got, data)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+const (
+	ipFlagDF         = 0x4000
+	ipFlagMF         = 0x2000
+	ipFragOffsetMask = 0x1fff
+	minIPV4MTU       = 68 //RFC 791
+)
+
+// Forwards the IP packets that are not addressed to the stack between the
+// interfaces of a routing table (RFC 1812). The router owns the devices of
+// its interfaces: the packets addressed to the stack read on them are
+// dropped, its connections go through the links of other interfaces.
+type Router struct {
+	routes *RoutingTable
+
+	mu        sync.Mutex
+	devices   map[string]PacketDevice
+	nat       *NAT
+	ct        *Conntrack
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewRouter(routes *RoutingTable) *Router {
+	return &Router{
+		routes:  routes,
+		devices: make(map[string]PacketDevice),
+		closed:  make(chan struct{})}
+}
+
+// Opens the device of the interface name and forwards the packets it reads
+func (r *Router) Attach(name string) error {
+	ifc := r.routes.Interface(name)
+	if ifc == nil {
+		return fmt.Errorf("No interface %s", name)
+	}
+	if ifc.Device == nil {
+		return fmt.Errorf("Interface %s cannot forward", name)
+	}
+
+	device, err := ifc.Device()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if _, ok := r.devices[name]; ok {
+		r.mu.Unlock()
+		device.Close()
+		return fmt.Errorf("Interface %s already attached", name)
+	}
+	r.devices[name] = device
+	r.mu.Unlock()
+
+	go r.receiver(ifc, device)
+	return nil
+}
+
+// Stops forwarding and closes the devices
+func (r *Router) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.mu.Lock()
+		for name, device := range r.devices {
+			device.Close()
+			delete(r.devices, name)
+		}
+		r.mu.Unlock()
+	})
+	return nil
+}
+
+// Translates the forwarded packets, nil disables the translation. The
+// flows are then tracked by the conntrack table of the NAT.
+func (r *Router) SetNAT(nat *NAT) {
+	r.mu.Lock()
+	r.nat = nat
+	if nat != nil {
+		r.ct = nat.Conntrack()
+	}
+	r.mu.Unlock()
+}
+
+// Tracks the forwarded flows without translating them, nil disables the
+// tracking. Ignored while a NAT is set.
+func (r *Router) SetConntrack(ct *Conntrack) {
+	r.mu.Lock()
+	if r.nat == nil {
+		r.ct = ct
+	}
+	r.mu.Unlock()
+}
+
+func (r *Router) getNAT() (*NAT, *Conntrack) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nat, r.ct
+}
+
+func (r *Router) device(name string) PacketDevice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.devices[name]
+}
+
+func (r *Router) receiver(ifc *Interface, device PacketDevice) {
+	fmt.Println("R: forwarding from", ifc.Name)
+	buffer := make([]byte, 65535)
+	for {
+		n, err := device.ReadPacket(buffer)
+		if err != nil {
+			select {
+			case <-r.closed:
+			default:
+				fmt.Println("R: read error on", ifc.Name, err)
+			}
+			return
+		}
+		r.forward(ifc, buffer[:n])
+	}
+}
+
+// Forwards a packet read on the interface in, it is modified in place
+func (r *Router) forward(in *Interface, packet []byte) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	headerLen := int(packet[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:]))
+	if headerLen < 20 || total < headerLen || total > len(packet) || ipChecksum(packet[:headerLen]) != 0 {
+		fmt.Println("R: malformed packet dropped on", in.Name)
+		return
+	}
+	packet = packet[:total]
+
+	src := net.IPv4(packet[12], packet[13], packet[14], packet[15])
+	dst := net.IPv4(packet[16], packet[17], packet[18], packet[19])
+	if !forwardable(src) || !forwardable(dst) {
+		return
+	}
+
+	//Destination translated before the route lookup, source after it
+	nat, ct := r.getNAT()
+	var flow *conntrackEntry
+	if nat != nil {
+		var ok bool
+		if flow, ok = nat.prerouting(packet, in); !ok {
+			return
+		}
+		dst = net.IPv4(packet[16], packet[17], packet[18], packet[19])
+	}
+
+	route, err := r.routes.Lookup(dst)
+	if r.routes.InterfaceOf(dst) != nil || (err == nil && route.Interface.Name == "lo") {
+		return //Addressed to the stack
+	}
+
+	//TTL of 1: it would be 0 at the next hop
+	if packet[8] <= 1 {
+		r.sendICMPError(in, packet, ICMPTypeTimeExceeded, 0, 0)
+		return
+	}
+
+	var out PacketDevice
+	if err == nil {
+		out = r.device(route.Interface.Name)
+	}
+	if out == nil {
+		r.sendICMPError(in, packet, ICMPTypeDestUnreachable, ICMPCodeNetUnreachable, 0)
+		return
+	}
+
+	mtu := route.Interface.MTU
+	if mtu < minIPV4MTU {
+		mtu = defaultMTU
+	}
+	if total > mtu && binary.BigEndian.Uint16(packet[6:])&ipFlagDF != 0 {
+		r.sendICMPError(in, packet, ICMPTypeDestUnreachable, ICMPCodeFragmentationNeeded, uint32(mtu)) //Next-hop MTU (RFC 1191)
+		return
+	}
+
+	if nat != nil {
+		if !nat.postrouting(packet, flow, route.Interface) {
+			return
+		}
+	} else if ct != nil {
+		ct.Track(packet) //Out of window segments are counted, not dropped
+	}
+	decrementTTL(packet)
+	fragments := [][]byte{packet}
+	if total > mtu {
+		fragments = fragmentIPV4(packet, mtu)
+	}
+	for _, fragment := range fragments {
+		if _, err := out.WritePacket(fragment); err != nil {
+			fmt.Println("R: write error on", route.Interface.Name, err)
+			return
+		}
+	}
+}
+
+// Addresses that are never forwarded (RFC 1812 5.3.7)
+func forwardable(addr net.IP) bool {
+	return !addr.IsUnspecified() && !addr.IsLoopback() && !addr.IsMulticast() && !addr.Equal(net.IPv4bcast)
+}
+
+// Decrements the TTL and updates the header checksum incrementally
+// (RFC 1624 equation 3), TTL and protocol form one 16 bits word.
+func decrementTTL(header []byte) {
+	old := binary.BigEndian.Uint16(header[8:])
+	header[8]--
+	updated := binary.BigEndian.Uint16(header[8:])
+	binary.BigEndian.PutUint16(header[10:], checksumUpdate(binary.BigEndian.Uint16(header[10:]), old, updated))
+}
+
+// Splits a packet into fragments of at most mtu bytes. The options not
+// marked as copied are only kept in the first fragment.
+func fragmentIPV4(packet []byte, mtu int) [][]byte {
+	headerLen := int(packet[0]&0xf) * 4
+	field := binary.BigEndian.Uint16(packet[6:])
+	offset := int(field&ipFragOffsetMask) * 8
+	moreFragments := field&ipFlagMF != 0
+
+	header := packet[:headerLen]
+	laterHeader := append(append([]byte{}, packet[:20]...), copiedOptions(packet[20:headerLen])...)
+	payload := packet[headerLen:]
+
+	var fragments [][]byte
+	for len(payload) > 0 {
+		size := (mtu - len(header)) &^ 7
+		last := size >= len(payload)
+		if last {
+			size = len(payload)
+		}
+
+		fragment := make([]byte, len(header)+size)
+		copy(fragment, header)
+		copy(fragment[len(header):], payload[:size])
+		fragment[0] = 0x40 | byte(len(header)/4)
+		binary.BigEndian.PutUint16(fragment[2:], uint16(len(fragment)))
+		flags := field &^ (ipFlagMF | ipFragOffsetMask)
+		if !last || moreFragments {
+			flags |= ipFlagMF
+		}
+		binary.BigEndian.PutUint16(fragment[6:], flags|uint16(offset/8))
+		fragment[10], fragment[11] = 0, 0
+		binary.BigEndian.PutUint16(fragment[10:], ipChecksum(fragment[:len(header)]))
+
+		fragments = append(fragments, fragment)
+		payload = payload[size:]
+		offset += size
+		header = laterHeader
+	}
+	return fragments
+}
+
+// Options with the copied flag, padded to a multiple of 4 bytes
+func copiedOptions(options []byte) []byte {
+	var copied []byte
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == 0 {
+			break //End of options
+		}
+		if kind == 1 {
+			i++ //NOP
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			break
+		}
+		length := int(options[i+1])
+		if kind&0x80 != 0 {
+			copied = append(copied, options[i:i+length]...)
+		}
+		i += length
+	}
+	for len(copied)%4 != 0 {
+		copied = append(copied, 0)
+	}
+	return copied
+}
+
+// Sends an ICMP error about packet to its source, from the address of the
+// interface it was received on. Never sent about an ICMP error or a fragment
+// other than the first one (RFC 1812 4.3.2.7).
+func (r *Router) sendICMPError(in *Interface, packet []byte, icmpType, code uint8, rest uint32) {
+	headerLen := int(packet[0]&0xf) * 4
+	if binary.BigEndian.Uint16(packet[6:])&ipFragOffsetMask != 0 {
+		return
+	}
+	if packet[9] == ProtocolICMP && len(packet) > headerLen && icmpErrorType(packet[headerLen]) {
+		return
+	}
+
+	src := net.IPv4(packet[12], packet[13], packet[14], packet[15])
+	route, err := r.routes.Lookup(src)
+	if err != nil {
+		return
+	}
+	out := r.device(route.Interface.Name)
+	if out == nil {
+		return
+	}
+	from := sourceAddr(in, src)
+	if from == nil {
+		from = route.Src
+	}
+
+	quoted := headerLen + 8
+	if quoted > len(packet) {
+		quoted = len(packet)
+	}
+	icmp := &ICMPPacket{Type: icmpType, Code: code, Rest: rest, Data: append([]byte{}, packet[:quoted]...)}
+	payload := icmp.Marshall()
+
+	reply := &IPV4Packet{
+		Version:        4,
+		IHL:            5,
+		Length:         uint16(20 + len(payload)),
+		Identification: uint16(rand.Int()),
+		TTL:            64,
+		Protocol:       ProtocolICMP,
+		SrcIp:          IPV4AddrToInt(from.String()),
+		DstIp:          IPV4AddrToInt(src.String()),
+		Payload:        payload}
+	if _, err := out.WritePacket(reply.Serialize()); err != nil {
+		fmt.Println("R: ICMP write error on", route.Interface.Name, err)
+	}
+}
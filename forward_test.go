@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// Device of a test interface, the packets the router writes are queued
+type testPacketDevice struct {
+	written chan []byte
+	closed  chan struct{}
+}
+
+func (d *testPacketDevice) ReadPacket(b []byte) (n int, err error) {
+	<-d.closed
+	return 0, errors.New("closed")
+}
+
+func (d *testPacketDevice) WritePacket(b []byte) (n int, err error) {
+	d.written <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (d *testPacketDevice) Close() error {
+	close(d.closed)
+	return nil
+}
+
+// Router between lan, 192.168.1.1/24, and wan, 203.0.113.1/24 with an MTU
+// of 576 and the default route
+func testRouter(t *testing.T) (r *Router, lan, wan *Interface, lanDevice, wanDevice *testPacketDevice) {
+	routes := NewRoutingTable()
+	newInterface := func(name string, addr net.IP, mtu int) (*Interface, *testPacketDevice) {
+		device := &testPacketDevice{written: make(chan []byte, 64), closed: make(chan struct{})}
+		ifc := &Interface{
+			Name:   name,
+			Addrs:  []*net.IPNet{{IP: addr.To4(), Mask: net.CIDRMask(24, 32)}},
+			MTU:    mtu,
+			Device: func() (PacketDevice, error) { return device, nil }}
+		if err := routes.AddInterface(ifc); err != nil {
+			t.Fatal(err)
+		}
+		return ifc, device
+	}
+	lan, lanDevice = newInterface("lan", net.IPv4(192, 168, 1, 1), 1500)
+	wan, wanDevice = newInterface("wan", net.IPv4(203, 0, 113, 1), 576)
+	routes.AddRoute(&net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, nil, "wan")
+
+	r = NewRouter(routes)
+	t.Cleanup(func() { r.Close() })
+	for _, name := range []string{"lan", "wan"} {
+		if err := r.Attach(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r, lan, wan, lanDevice, wanDevice
+}
+
+func written(t *testing.T, device *testPacketDevice) []byte {
+	t.Helper()
+	select {
+	case packet := <-device.written:
+		return packet
+	case <-time.After(time.Second):
+		t.Fatal("nothing written")
+		return nil
+	}
+}
+
+func nothingWritten(t *testing.T, device *testPacketDevice) {
+	t.Helper()
+	select {
+	case packet := <-device.written:
+		t.Fatalf("packet written: % x", packet[:20])
+	default:
+	}
+}
+
+func withTTL(packet []byte, ttl uint8) []byte {
+	packet[8] = ttl
+	fillChecksums(packet, true)
+	return packet
+}
+
+// Checks an ICMP error sent by the router about packet
+func checkICMPError(t *testing.T, reply, packet []byte, from string, icmpType, code uint8) *ICMPPacket {
+	t.Helper()
+	if ipChecksum(reply[:20]) != 0 || icmpChecksum(reply[20:]) != 0 {
+		t.Error("ICMP error checksums")
+	}
+	if reply[9] != ProtocolICMP || net.IP(reply[12:16]).String() != from || !bytes.Equal(reply[16:20], packet[12:16]) {
+		t.Fatalf("not an ICMP error from %s to the source: % x", from, reply[:20])
+	}
+	icmp := NewICMPPacket(reply[20:])
+	if icmp.Type != icmpType || icmp.Code != code {
+		t.Fatalf("ICMP type %d code %d, want %d %d", icmp.Type, icmp.Code, icmpType, code)
+	}
+	if !bytes.Equal(icmp.Data, packet[:28]) {
+		t.Error("quoted packet")
+	}
+	return icmp
+}
+
+func TestForwardTTL(t *testing.T) {
+	r, lan, _, lanDevice, wanDevice := testRouter(t)
+	packet := testPacket{protocol: ProtocolUDP, src: "192.168.1.10", dst: "198.51.100.7", sport: 4000, dport: 53, payload: []byte("query")}
+
+	r.forward(lan, withTTL(packet.build(), 2))
+	forwarded := written(t, wanDevice)
+	if forwarded[8] != 1 || ipChecksum(forwarded[:20]) != 0 {
+		t.Error("TTL", forwarded[8], "checksum", ipChecksum(forwarded[:20]))
+	}
+
+	expired := withTTL(packet.build(), 1)
+	r.forward(lan, append([]byte(nil), expired...))
+	nothingWritten(t, wanDevice)
+	checkICMPError(t, written(t, lanDevice), expired, "192.168.1.1", ICMPTypeTimeExceeded, 0)
+}
+
+func TestForwardFragmentationNeeded(t *testing.T) {
+	r, lan, _, lanDevice, wanDevice := testRouter(t)
+	big := testPacket{protocol: ProtocolUDP, src: "192.168.1.10", dst: "198.51.100.7", sport: 4000, dport: 53, payload: make([]byte, 1000)}.build()
+	binary.BigEndian.PutUint16(big[6:], ipFlagDF)
+	fillChecksums(big, true)
+
+	r.forward(lan, append([]byte(nil), big...))
+	nothingWritten(t, wanDevice)
+	icmp := checkICMPError(t, written(t, lanDevice), big, "192.168.1.1", ICMPTypeDestUnreachable, ICMPCodeFragmentationNeeded)
+	if icmp.Rest != 576 {
+		t.Error("next-hop MTU", icmp.Rest)
+	}
+
+	//Without DF the packet is fragmented
+	binary.BigEndian.PutUint16(big[6:], 0)
+	fillChecksums(big, true)
+	r.forward(lan, big)
+	for i := 0; i < 2; i++ {
+		if fragment := written(t, wanDevice); len(fragment) > 576 {
+			t.Error("fragment of", len(fragment), "bytes")
+		}
+	}
+}
+
+// Errors are never sent about ICMP errors, but they are about queries
+func TestForwardNoICMPErrorAboutError(t *testing.T) {
+	r, lan, _, lanDevice, _ := testRouter(t)
+	for _, c := range []struct {
+		icmpType uint8
+		answered bool
+	}{
+		{ICMPTypeEcho, true},
+		{13, true}, //Timestamp
+		{ICMPTypeDestUnreachable, false},
+		{ICMPTypeTimeExceeded, false},
+		{ICMPTypeParameterProblem, false},
+	} {
+		packet := testPacket{protocol: ProtocolICMP, src: "192.168.1.10", dst: "198.51.100.7", sport: 7, flags: c.icmpType, payload: make([]byte, 28)}.build()
+		r.forward(lan, withTTL(packet, 1))
+		if c.answered {
+			written(t, lanDevice)
+		} else {
+			nothingWritten(t, lanDevice)
+		}
+	}
+}
+
+func TestFragmentIPV4(t *testing.T) {
+	options := []byte{
+		0x83, 7, 4, 10, 0, 0, 1, //Loose source route, copied
+		0x07, 7, 4, 0, 0, 0, 0, //Record route, first fragment only
+		1, 0} //NOP, end of options
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+	header := make([]byte, 20+len(options))
+	header[0] = 0x40 | byte(len(header)/4)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(header)+len(payload)))
+	binary.BigEndian.PutUint16(header[4:], 0x4242)
+	header[8], header[9] = 64, ProtocolUDP
+	copy(header[12:], net.IPv4(192, 168, 1, 10).To4())
+	copy(header[16:], net.IPv4(198, 51, 100, 7).To4())
+	copy(header[20:], options)
+	binary.BigEndian.PutUint16(header[10:], ipChecksum(header))
+	packet := append(header, payload...)
+
+	for _, c := range []struct {
+		name          string
+		offset        int //Of the packet, already a fragment
+		moreFragments bool
+	}{{"packet", 0, false}, {"middle fragment", 2000, true}} {
+		t.Run(c.name, func(t *testing.T) {
+			p := append([]byte(nil), packet...)
+			field := uint16(c.offset / 8)
+			if c.moreFragments {
+				field |= ipFlagMF
+			}
+			binary.BigEndian.PutUint16(p[6:], field)
+			p[10], p[11] = 0, 0
+			binary.BigEndian.PutUint16(p[10:], ipChecksum(p[:len(header)]))
+
+			fragments := fragmentIPV4(p, 300)
+			var reassembled []byte
+			for i, fragment := range fragments {
+				headerLen := int(fragment[0]&0xf) * 4
+				last := i == len(fragments)-1
+				if len(fragment) > 300 || int(binary.BigEndian.Uint16(fragment[2:])) != len(fragment) {
+					t.Fatal("fragment", i, "length", len(fragment))
+				}
+				if ipChecksum(fragment[:headerLen]) != 0 {
+					t.Error("fragment", i, "checksum")
+				}
+				if binary.BigEndian.Uint16(fragment[4:]) != 0x4242 {
+					t.Error("fragment", i, "identification")
+				}
+				field := binary.BigEndian.Uint16(fragment[6:])
+				if offset := int(field&ipFragOffsetMask) * 8; offset != c.offset+len(reassembled) {
+					t.Fatal("fragment", i, "offset", offset, "want", c.offset+len(reassembled))
+				}
+				if mf := field&ipFlagMF != 0; mf != (!last || c.moreFragments) {
+					t.Error("fragment", i, "MF", mf)
+				}
+				if !last && (len(fragment)-headerLen)%8 != 0 {
+					t.Error("fragment", i, "data not a multiple of 8 bytes")
+				}
+
+				wantOptions := options
+				if i > 0 {
+					wantOptions = []byte{0x83, 7, 4, 10, 0, 0, 1, 0}
+				}
+				if !bytes.Equal(fragment[20:headerLen], wantOptions) {
+					t.Errorf("fragment %d options % x, want % x", i, fragment[20:headerLen], wantOptions)
+				}
+				reassembled = append(reassembled, fragment[headerLen:]...)
+			}
+			if len(fragments) < 4 || !bytes.Equal(reassembled, payload) {
+				t.Error(len(fragments), "fragments, reassembled payload differs")
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+const (
+	ProtocolICMP = 1
+	ProtocolTCP  = 6
+	ProtocolUDP  = 17
+)
+
+const (
+	ICMPTypeEchoReply        = 0
+	ICMPTypeDestUnreachable  = 3
+	ICMPTypeSourceQuench     = 4
+	ICMPTypeRedirect         = 5
+	ICMPTypeEcho             = 8
+	ICMPTypeTimeExceeded     = 11
+	ICMPTypeParameterProblem = 12
+)
+
+// Destination unreachable codes
+const (
+	ICMPCodeNetUnreachable      = 0
+	ICMPCodeHostUnreachable     = 1
+	ICMPCodeProtocolUnreachable = 2
+	ICMPCodePortUnreachable     = 3
+	ICMPCodeFragmentationNeeded = 4
+	ICMPCodeSourceRouteFailed   = 5
+	ICMPCodeAdminProhibited     = 13
+)
+
+type ICMPPacket struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	Rest     uint32 //Content depends on the type (id/seq, next-hop MTU, unused...)
+	Data     []byte
+}
+
+func NewICMPPacket(data []byte) *ICMPPacket {
+	var p ICMPPacket
+	reader := bytes.NewReader(data)
+	binary.Read(reader, binary.BigEndian, &p.Type)
+	binary.Read(reader, binary.BigEndian, &p.Code)
+	binary.Read(reader, binary.BigEndian, &p.Checksum)
+	binary.Read(reader, binary.BigEndian, &p.Rest)
+
+	if len(data) > 8 {
+		p.Data = data[8:]
+	}
+	return &p
+}
+
+func (p *ICMPPacket) Marshall() []byte {
+	p.Checksum = 0
+
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, p.Type)
+	binary.Write(buffer, binary.BigEndian, p.Code)
+	binary.Write(buffer, binary.BigEndian, p.Checksum)
+	binary.Write(buffer, binary.BigEndian, p.Rest)
+	binary.Write(buffer, binary.BigEndian, p.Data)
+
+	output := buffer.Bytes()
+	if len(output)%2 != 0 {
+		output = append(output, 0) //ipChecksum only sums full words
+		p.Checksum = ipChecksum(output)
+		output = output[:len(output)-1]
+	} else {
+		p.Checksum = ipChecksum(output)
+	}
+
+	output[2] = byte(p.Checksum >> 8)
+	output[3] = byte(p.Checksum)
+	return output
+}
+
+// Destination unreachable message received for a TCP segment we sent
+type ICMPUnreachableError struct {
+	Code     uint8
+	From     uint32 //Address of the host or router that sent the message
+	SrcPort  uint16 //Ports of the TCP segment that triggered it
+	DestPort uint16
+}
+
+func (e *ICMPUnreachableError) Error() string {
+	return fmt.Sprintf("ICMP destination unreachable (code %d) from %s", e.Code, DecodeIPV4Addr(e.From))
+}
+
+func (e *ICMPUnreachableError) Unwrap() error {
+	switch e.Code {
+	case ICMPCodeNetUnreachable:
+		return syscall.ENETUNREACH
+	case ICMPCodeProtocolUnreachable:
+		return syscall.ENOPROTOOPT
+	case ICMPCodePortUnreachable:
+		return syscall.ECONNREFUSED
+	case ICMPCodeFragmentationNeeded:
+		return syscall.EMSGSIZE
+	}
+	return syscall.EHOSTUNREACH
+}
+
+// Net and host unreachable are transient (RFC 1122 4.2.3.9), they must not
+// abort a connection on their own.
+func (e *ICMPUnreachableError) Soft() bool {
+	return e.Code == ICMPCodeNetUnreachable || e.Code == ICMPCodeHostUnreachable || e.Code == ICMPCodeSourceRouteFailed
+}
+
+// Error messages, the other types are queries (RFC 1812 4.3.2.7)
+func icmpErrorType(icmpType uint8) bool {
+	switch icmpType {
+	case ICMPTypeDestUnreachable, ICMPTypeSourceQuench, ICMPTypeRedirect, ICMPTypeTimeExceeded, ICMPTypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+// Converts an ICMP error about one of our TCP segments into an error,
+// nil for any other ICMP message.
+func icmpError(packet *IPV4Packet) error {
+	icmp := NewICMPPacket(packet.Payload)
+	if icmp.Type != ICMPTypeDestUnreachable || len(icmp.Data) < 20 {
+		return nil
+	}
+
+	original := NewIPV4Packet(icmp.Data)
+	headerLen := int(original.IHL) * 4
+	if original.Protocol != ProtocolTCP || headerLen < 20 || len(icmp.Data) < headerLen+4 {
+		return nil
+	}
+
+	return &ICMPUnreachableError{
+		Code:     icmp.Code,
+		From:     packet.SrcIp,
+		SrcPort:  binary.BigEndian.Uint16(icmp.Data[headerLen:]),
+		DestPort: binary.BigEndian.Uint16(icmp.Data[headerLen+2:])}
+}
@@ -11,22 +11,12 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
-func FD_SET(i int, p *syscall.FdSet) {
-	p.Bits[i/64] |= 1 << uint(i) % 64
-}
-
-func FD_ISSET(i int, p *syscall.FdSet) bool {
-	return (p.Bits[i/64] & (1 << uint(i) % 64)) != 0
-}
-
-func FD_ZERO(p *syscall.FdSet) {
-	for i := range p.Bits {
-		p.Bits[i] = 0
-	}
-}
+var ErrReadTimeout = errors.New("Read timeout")
 
 type IPV4Packet struct {
 	Version        uint8 //4 bits
@@ -93,14 +83,20 @@ func NewIPV4Packet(data []byte) *IPV4Packet {
 		//Skip option for now
 	}
 
-	headerSize := uint16((p.IHL * 32) / 8)
-	if p.Length > headerSize {
+	headerSize := int(p.IHL) * 4
+	if int(p.Length) > headerSize && headerSize <= len(data) {
 		p.Payload = data[headerSize:]
 	}
 
 	return &p
 }
 
+// Header consistent with the size of the packet read: the payload can be
+// cut to the total length
+func (p *IPV4Packet) validLength(size int) bool {
+	return p.IHL >= 5 && int(p.IHL)*4 <= int(p.Length) && int(p.Length) <= size
+}
+
 func (p *IPV4Packet) Serialize() []byte {
 	p.Checksum = 0
 
@@ -200,18 +196,77 @@ func ipChecksum(ipBuffer []byte) uint16 {
 	return uint16(^sum)
 }
 
+// IP layer under a TeaCPConn: Write sends a TCP segment to the remote
+// address, Read returns the next TCP segment addressed to the local one.
+type IPConn interface {
+	Read(b []byte) (n int, err error)
+	Write(b []byte) (n int, err error)
+	Close() error
+	LocalAddr() net.IPAddr
+	RemoteAddr() net.IPAddr
+}
+
 type TunIPConn struct {
-	tunFile    *os.File
+	name       string //Device, tun11 if empty
+	queues     []*tunQueue
 	localAddr  *net.IPAddr
 	remoteAddr *net.IPAddr
+	vnetHdr    bool //Packets are preceded by a virtio net header, GSO is used
+	attached   bool //Owner of the device in this process
 
 	srcField uint32
 	dstField uint32
 }
 
+// Devices attached by this process. Their other opens would fail, or share
+// the queues of a multi-queue device and receive the flows of the owner.
+var tunAttached = struct {
+	mu    sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// Reserves the device name for this process, fails if it is already attached
+func attachTun(name string) error {
+	tunAttached.mu.Lock()
+	defer tunAttached.mu.Unlock()
+	if tunAttached.names[name] {
+		return &TunInUseError{name}
+	}
+	tunAttached.names[name] = true
+	return nil
+}
+
+func detachTun(name string) {
+	tunAttached.mu.Lock()
+	delete(tunAttached.names, name)
+	tunAttached.mu.Unlock()
+}
+
+// Queue of the TUN device with its own fd (IFF_MULTI_QUEUE)
+type tunQueue struct {
+	file       *os.File
+	readBuffer []byte //Reads of a queue are done by a single goroutine
+	readErr    error  //ICMP error read in the middle of a batch
+}
+
+// GSO size of the last packet read with a virtio net header, 0 if it is a
+// single segment
+func (q *tunQueue) gsoSize() int {
+	var hdr virtioNetHdr
+	hdr.decode(q.readBuffer)
+	if hdr.gsoType&^virtioNetHdrGSOECN != virtioNetHdrGSOTCPv4 {
+		return 0
+	}
+	return int(hdr.gsoSize)
+}
+
+// remoteAddr can be nil for a listener, which only uses ReadFrom and WriteTo
 func NewTunIPConn(localAddr, remoteAddr *net.IPAddr) *TunIPConn {
 	srcField := IPV4AddrToInt(localAddr.IP.String())
-	dstField := IPV4AddrToInt(remoteAddr.IP.String())
+	var dstField uint32
+	if remoteAddr != nil {
+		dstField = IPV4AddrToInt(remoteAddr.IP.String())
+	}
 
 	return &TunIPConn{
 		localAddr:  localAddr,
@@ -229,39 +284,135 @@ func (c *TunIPConn) LocalAddr() net.IPAddr {
 }
 
 func (c *TunIPConn) Open() error {
-	file, err := os.OpenFile("/dev/tun11", os.O_RDWR, os.ModeCharDevice)
-	if err != nil {
+	return c.OpenQueues(1)
+}
+
+// TUN device already attached to a connection, a listener or a router.
+// A device is not shared: each dialed connection and each listener needs
+// its own one.
+type TunInUseError struct {
+	Name string
+}
+
+func (e *TunInUseError) Error() string {
+	return fmt.Sprintf("TUN device %s in use by another connection, listener or router", e.Name)
+}
+
+func (e *TunInUseError) Unwrap() error {
+	return syscall.EBUSY
+}
+
+// Opens n queues of the device. The kernel spreads the flows over them,
+// each one must be read by ReadQueueFrom. The device is opened
+// exclusively, the open fails with a *TunInUseError if it is in use.
+func (c *TunIPConn) OpenQueues(n int) error {
+	if c.name == "" {
+		c.name = "tun11"
+	}
+	if err := attachTun(c.name); err != nil {
 		return err
 	}
+	c.attached = true
+	for i := 0; i < n; i++ {
+		file, vnetHdr, err := openTunDevice(c.name, n > 1)
+		if err == nil && i > 0 && vnetHdr != c.vnetHdr {
+			file.Close()
+			err = fmt.Errorf("Inconsistent offloads between the queues of %s", c.name)
+		}
+		if errors.Is(err, syscall.EBUSY) {
+			err = &TunInUseError{c.name}
+		}
+		if err != nil {
+			c.Close()
+			c.queues = nil
+			return err
+		}
 
-	c.tunFile = file
+		c.vnetHdr = vnetHdr
+		c.queues = append(c.queues, &tunQueue{
+			file:       file,
+			readBuffer: make([]byte, 65536+virtioNetHdrLen)})
+	}
 	return nil
 }
 
+func (c *TunIPConn) NumQueues() int {
+	return len(c.queues)
+}
+
+// Pending reads return os.ErrClosed
 func (c *TunIPConn) Close() error {
-	err := c.tunFile.Close()
-	if err != nil {
-		return err
+	if c.attached {
+		detachTun(c.name)
+		c.attached = false
 	}
-	c.tunFile = nil
-	return nil
+	var err error
+	for _, q := range c.queues {
+		if e := q.file.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (c *TunIPConn) Write(data []byte) (n int, err error) {
+	return c.write(data, c.dstField, ECNNotECT)
+}
+
+func (c *TunIPConn) WriteECN(data []byte, ecn uint8) (n int, err error) {
+	return c.write(data, c.dstField, ecn)
+}
+
+func (c *TunIPConn) WriteTo(data []byte, addr *net.IPAddr) (n int, err error) {
+	return c.write(data, IPV4AddrToInt(addr.IP.String()), ECNNotECT)
+}
+
+func (c *TunIPConn) WriteToECN(data []byte, addr *net.IPAddr, ecn uint8) (n int, err error) {
+	return c.write(data, IPV4AddrToInt(addr.IP.String()), ecn)
+}
+
+// IP packet carrying a TCP segment
+func newTCPIPV4Packet(src, dst uint32, ecn uint8, data []byte) *IPV4Packet {
 	packet := &IPV4Packet{}
-	packet.SrcIp = c.srcField
-	packet.DstIp = c.dstField
+	packet.ECN = ecn
+	packet.SrcIp = src
+	packet.DstIp = dst
 	packet.Version = 4
 	packet.IHL = 5
 	packet.Length = uint16(20 + len(data))
 	packet.Identification = uint16(rand.Int())
 	packet.TTL = 64
-	packet.Protocol = 6
+	packet.Protocol = ProtocolTCP
 	packet.Payload = data
+	return packet
+}
 
-	bytes := packet.Serialize()
+// Checks an IP packet read from a link: true for a TCP segment addressed to
+// local, the error of an ICMP message about one of our segments, false for
+// anything else.
+func acceptIPV4Packet(packet *IPV4Packet, local uint32) (bool, error) {
+	if packet.DstIp != local {
+		log.Println("Unwanted IP packet with destination:", DecodeIPV4Addr(packet.DstIp))
+	} else if packet.Protocol == ProtocolICMP {
+		if err := icmpError(packet); err != nil {
+			return false, err
+		}
+		log.Println("Unhandled ICMP packet from:", DecodeIPV4Addr(packet.SrcIp))
+	} else if packet.Protocol != ProtocolTCP {
+		log.Println("Unwanted IP packet with protocol:", packet.Protocol)
+	} else {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (c *TunIPConn) write(data []byte, dst uint32, ecn uint8) (n int, err error) {
+	bytes := newTCPIPV4Packet(c.srcField, dst, ecn, data).Serialize()
+	if c.vnetHdr {
+		bytes = append(make([]byte, virtioNetHdrLen), bytes...) //No offload
+	}
 
-	length, err := c.tunFile.Write(bytes)
+	length, err := c.queueFor(dst, data).file.Write(bytes)
 	if err != nil {
 		return -1, err
 	}
@@ -269,39 +420,210 @@ func (c *TunIPConn) Write(data []byte) (n int, err error) {
 	return length - (len(bytes) - len(data)), nil
 }
 
+// Writes of a flow always use the same queue
+func (c *TunIPConn) queueFor(dst uint32, segment []byte) *tunQueue {
+	if len(c.queues) == 1 || len(segment) < 4 {
+		return c.queues[0]
+	}
+	hash := flowHash(dst, binary.BigEndian.Uint16(segment[2:]), binary.BigEndian.Uint16(segment[0:]))
+	return c.queues[hash%uint32(len(c.queues))]
+}
+
 func (c *TunIPConn) Read(b []byte) (n int, err error) {
-	buffer := make([]byte, len(b)+60) //60 bytes : max IP Header's length
+	n, _, _, err = c.ReadFromECN(b)
+	return n, err
+}
+
+func (c *TunIPConn) ReadECN(b []byte) (n int, ecn uint8, err error) {
+	n, _, ecn, err = c.ReadFromECN(b)
+	return n, ecn, err
+}
 
-	fd := int(c.tunFile.Fd())
-	readFdSet := new(syscall.FdSet)
-	FD_SET(fd, readFdSet)
+func (c *TunIPConn) ReadFrom(b []byte) (n int, addr *net.IPAddr, err error) {
+	n, addr, _, err = c.ReadFromECN(b)
+	return n, addr, err
+}
 
-	timeout := syscall.NsecToTimeval(1000000000)
+// Also returns the ECN field of the IP header. Only reads the first queue,
+// the other ones are read with ReadQueueFrom: a multi-queue device is meant
+// for a listener reading all of them.
+func (c *TunIPConn) ReadFromECN(b []byte) (n int, addr *net.IPAddr, ecn uint8, err error) {
+	return c.ReadQueueFrom(0, b)
+}
 
-	e := syscall.Select(fd+1, readFdSet, nil, nil, &timeout)
-	if e != nil {
-		return -1, e
+// Reads a packet from the given queue. Each queue can be read by its own
+// goroutine.
+func (c *TunIPConn) ReadQueueFrom(queue int, b []byte) (n int, addr *net.IPAddr, ecn uint8, err error) {
+	packet, err := c.nextPacket(c.queues[queue])
+	if err != nil {
+		return -1, nil, 0, err
 	}
+	return copy(b, packet.Payload), &net.IPAddr{IP: net.ParseIP(DecodeIPV4Addr(packet.SrcIp))}, packet.ECN, nil
+}
 
-	if !FD_ISSET(fd, readFdSet) {
-		return -1, errors.New("Read timeout")
+// Blocks until a packet for us is read from the queue
+func (c *TunIPConn) nextPacket(q *tunQueue) (*IPV4Packet, error) {
+	if q.readErr != nil {
+		var err error
+		err, q.readErr = q.readErr, nil
+		return nil, err
 	}
 
-	var packet *IPV4Packet
-	var length int
 	for {
-		length, err = c.tunFile.Read(buffer)
+		packet, err := c.readPacket(q)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, ErrReadTimeout
+		}
 		if err != nil {
-			return -1, err
+			return nil, err
+		}
+		if packet != nil {
+			return packet, nil
 		}
+	}
+}
 
-		packet = NewIPV4Packet(buffer[:length])
-		if packet.DstIp != c.srcField {
-			log.Println("Unwanted IP packet with destination:", DecodeIPV4Addr(packet.DstIp))
-		} else {
+// Reads until the deadline, with no deadline set a read only returns with
+// a packet or when the device is closed
+func (c *TunIPConn) SetReadDeadline(t time.Time) error {
+	var err error
+	for _, q := range c.queues {
+		if e := q.file.SetReadDeadline(t); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Reads one packet from the device, the read parks in the runtime poller.
+// Returns nil if the packet is not for us.
+func (c *TunIPConn) readPacket(q *tunQueue) (*IPV4Packet, error) {
+	length, err := q.file.Read(q.readBuffer)
+	if err != nil {
+		return nil, err
+	}
+	return c.parsePacket(q.readBuffer[:length])
+}
+
+// Reads one packet only if one is queued, false otherwise
+func (c *TunIPConn) tryReadPacket(q *tunQueue) (*IPV4Packet, bool, error) {
+	rawConn, err := q.file.SyscallConn()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var length int
+	var readErr error
+	err = rawConn.Read(func(fd uintptr) bool {
+		length, readErr = syscall.Read(int(fd), q.readBuffer)
+		return true //Do not wait for the fd to be readable
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if readErr == syscall.EAGAIN || readErr == syscall.EINTR {
+		return nil, false, nil
+	}
+	if readErr != nil {
+		return nil, false, os.NewSyscallError("read", readErr)
+	}
+	packet, err := c.parsePacket(q.readBuffer[:length])
+	return packet, true, err
+}
+
+// A packet coalesced by the kernel (GRO) is returned as a single large
+// segment, only ReadBatch splits it
+func (c *TunIPConn) parsePacket(data []byte) (*IPV4Packet, error) {
+	length := len(data)
+	if c.vnetHdr {
+		if length < virtioNetHdrLen {
+			return nil, nil
+		}
+		data = data[virtioNetHdrLen:] //The checksum may be partial, it is not verified
+	}
+
+	packet := NewIPV4Packet(data)
+	ok, err := acceptIPV4Packet(packet, c.srcField)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if c.remoteAddr != nil && packet.SrcIp != c.dstField {
+		return nil, nil //Segment of another flow
+	}
+	return packet, nil
+}
+
+// Reads the segments already queued on the first queue after the first
+// one, up to len(segments). With virtio net headers, a packet coalesced by
+// the kernel is split back into its segments: one read(2) fills several of
+// them. Other packets still take one read(2) each, a TUN fd has no batch
+// read: only the trips through the runtime poller are saved.
+func (c *TunIPConn) ReadBatch(segments []Segment) (n int, err error) {
+	if len(segments) == 0 {
+		return 0, nil
+	}
+
+	q := c.queues[0]
+	packet, err := c.nextPacket(q)
+	if err != nil {
+		return 0, err
+	}
+	n = c.splitPacket(q, packet, segments)
+
+	for n < len(segments) {
+		packet, ok, err := c.tryReadPacket(q)
+		if err != nil {
+			q.readErr = err //Returned by the next read
+			break
+		}
+		if !ok {
 			break
 		}
+		if packet == nil {
+			continue
+		}
+		n += c.splitPacket(q, packet, segments[n:])
+	}
+	return n, nil
+}
+
+// Copies the segment of packet, the last one read from q, into segments.
+// Returns the number of segments filled.
+func (c *TunIPConn) splitPacket(q *tunQueue, packet *IPV4Packet, segments []Segment) int {
+	gsoSize := 0
+	if c.vnetHdr {
+		gsoSize = q.gsoSize()
+	}
+	n := splitSegment(packet.Payload, gsoSize, segments)
+	for i := range segments[:n] {
+		segments[i].ECN = packet.ECN
 	}
+	return n
+}
 
-	return copy(b, packet.Payload), nil
+func (c *TunIPConn) WriteBatch(segments []Segment) (n int, err error) {
+	return c.WriteBatchTo(segments, c.remoteAddr)
+}
+
+// With virtio net headers, consecutive segments of a bulk transfer are
+// coalesced and written at once, the kernel splits them again (GSO).
+// Without them each segment is still written by its own write(2).
+func (c *TunIPConn) WriteBatchTo(segments []Segment, addr *net.IPAddr) (n int, err error) {
+	dst := IPV4AddrToInt(addr.IP.String())
+	for n < len(segments) {
+		count := 1
+		var packet []byte
+		if c.vnetHdr {
+			packet, count = coalesceSegments(segments[n:], c.srcField, dst)
+		} else {
+			packet = newTCPIPV4Packet(c.srcField, dst, segments[n].ECN, segments[n].Data).Serialize()
+		}
+
+		_, err = c.queueFor(dst, segments[n].Data).file.Write(packet)
+		if err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultKeepAliveIdle     = 15 * time.Second
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCount    = 9
+)
+
+// Keep-alive parameters (RFC 1122 4.2.3.6). After Idle without any segment
+// from the peer a probe is sent every Interval, the connection is aborted
+// after Count unanswered probes.
+type KeepAliveConfig struct {
+	Enable   bool
+	Idle     time.Duration
+	Interval time.Duration
+	Count    int
+}
+
+func (t *TeaCPConn) SetKeepAlive(keepalive bool) error {
+	t.sendCond.L.Lock()
+	defer t.sendCond.L.Unlock()
+
+	t.keepAlive.Enable = keepalive
+	t.scheduleKeepAlive()
+	return nil
+}
+
+// Sets both the idle time and the interval between probes
+func (t *TeaCPConn) SetKeepAlivePeriod(d time.Duration) error {
+	t.sendCond.L.Lock()
+	defer t.sendCond.L.Unlock()
+
+	t.keepAlive.Idle = d
+	t.keepAlive.Interval = d
+	t.scheduleKeepAlive()
+	return nil
+}
+
+// Zero values of Idle, Interval and Count keep the current parameters
+func (t *TeaCPConn) SetKeepAliveConfig(config KeepAliveConfig) error {
+	t.sendCond.L.Lock()
+	defer t.sendCond.L.Unlock()
+
+	t.keepAlive.Enable = config.Enable
+	if config.Idle > 0 {
+		t.keepAlive.Idle = config.Idle
+	}
+	if config.Interval > 0 {
+		t.keepAlive.Interval = config.Interval
+	}
+	if config.Count > 0 {
+		t.keepAlive.Count = config.Count
+	}
+	t.scheduleKeepAlive()
+	return nil
+}
+
+// Must be called with sendCond.L held
+func (t *TeaCPConn) scheduleKeepAlive() {
+	if t.keepAliveTimer != nil {
+		t.keepAliveTimer.Stop()
+		t.keepAliveTimer = nil
+	}
+	if !t.keepAlive.Enable || t.err != nil {
+		return
+	}
+
+	delay := t.keepAlive.Idle - time.Since(t.lastReceived)
+	if t.keepAliveProbes > 0 {
+		delay = t.keepAlive.Interval - time.Since(t.lastProbe)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	t.keepAliveTimer = time.AfterFunc(delay, t.onKeepAlive)
+}
+
+func (t *TeaCPConn) onKeepAlive() {
+	t.sendCond.L.Lock()
+	t.keepAliveTimer = nil
+	if !t.keepAlive.Enable || t.err != nil {
+		t.sendCond.L.Unlock()
+		return
+	}
+
+	if t.keepAliveProbes == 0 && time.Since(t.lastReceived) < t.keepAlive.Idle {
+		t.scheduleKeepAlive() //A segment arrived in the meantime
+		t.sendCond.L.Unlock()
+		return
+	}
+
+	if t.keepAliveProbes >= t.keepAlive.Count {
+		t.sendCond.L.Unlock()
+		fmt.Println("K:", t.keepAliveProbes, "keep-alive probes unanswered")
+		t.abort(syscall.ETIMEDOUT)
+		return
+	}
+
+	//Only an idle connection is probed, the retransmissions watch the others
+	if len(t.ackWaitingBuffer) == 0 && len(t.sendBuffer) == 0 {
+		t.keepAliveProbes++
+		t.keepAliveProbe = true
+		t.sendCond.Signal()
+	}
+	t.lastProbe = time.Now()
+	t.keepAliveTimer = time.AfterFunc(t.keepAlive.Interval, t.onKeepAlive)
+	t.sendCond.L.Unlock()
+}
+
+// A segment was received from the peer. Must be called with sendCond.L held
+func (t *TeaCPConn) keepAliveReceived() {
+	t.lastReceived = time.Now()
+	if t.keepAliveProbes > 0 {
+		t.keepAliveProbes = 0
+		t.scheduleKeepAlive()
+	}
+}
+
+// Probe with SEG.SEQ = SND.NXT - 1, which the peer must acknowledge. It
+// carries the negotiated options like any other segment, a PAWS peer drops
+// a probe without timestamps (RFC 7323 3.2).
+// Must be called with sendCond.L held
+func (t *TeaCPConn) sendKeepAliveProbe(localIp, remotetIp string) *TCPPacket {
+	t.keepAliveProbe = false
+
+	packet := &TCPPacket{}
+	packet.SrcPort = t.sourcePort
+	packet.DestPort = t.destPort
+	packet.DataOffset = uint8(5)
+	packet.SeqNum = t.localSeqNumber - 1
+	packet.AckNum = t.remoteSeqNumber
+	packet.WindowSize = uint16(receiveWindow)
+	packet.SetFlag(FlagACK)
+	t.addOptions(packet)
+	ecn := t.markECN(packet, false)
+
+	_, err := t.writeSegment(packet.Marshall(localIp, remotetIp), ecn)
+	if err != nil {
+		fmt.Println("Failed to send keep-alive probe due to error: ", err)
+	}
+	return packet
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The probes of an idle connection are acknowledged, it outlives Count
+// intervals
+func TestKeepAliveIdleConnection(t *testing.T) {
+	client, server := loopbackPair(t, 35, 7035)
+	client.SetKeepAliveConfig(KeepAliveConfig{Enable: true, Idle: 100 * time.Millisecond, Interval: 100 * time.Millisecond, Count: 3})
+
+	time.Sleep(800 * time.Millisecond)
+	client.sendCond.L.Lock()
+	err, probes := client.err, client.keepAliveProbes
+	client.sendCond.L.Unlock()
+	if err != nil {
+		t.Fatal("idle connection aborted:", err)
+	}
+	if probes > 1 {
+		t.Error(probes, "probes unanswered")
+	}
+	exchange(t, client, server, "still there")
+	exchange(t, server, client, "still here")
+}
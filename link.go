@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// IP connection of a link device, not bound to a remote address. A listener
+// shares it between its connections.
+type LinkConn interface {
+	IPConn
+	ECNConn
+	ReadFromECN(b []byte) (n int, addr *net.IPAddr, ecn uint8, err error)
+	WriteToECN(b []byte, addr *net.IPAddr, ecn uint8) (n int, err error)
+}
+
+// TCP segment and the ECN field of its IP header, element of a batch
+type Segment struct {
+	Data []byte
+	ECN  uint8
+}
+
+// Implemented by the IP connections that move several segments per call
+type BatchConn interface {
+	// Fills the Data buffers of segments up to their capacity and reslices
+	// them to the segments read. Blocks only for the first one.
+	ReadBatch(segments []Segment) (n int, err error)
+	WriteBatch(segments []Segment) (n int, err error)
+}
+
+// Implemented by the links that write a batch to any address
+type BatchLink interface {
+	WriteBatchTo(segments []Segment, addr *net.IPAddr) (n int, err error)
+}
+
+// Implemented by the links whose reads block until a deadline rather than
+// returning ErrReadTimeout periodically
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Sets the read deadline of conn if it supports one, a time in the past
+// interrupts a pending read
+func setReadDeadline(conn IPConn, t time.Time) {
+	if d, ok := conn.(readDeadliner); ok {
+		d.SetReadDeadline(t)
+	}
+}
+
+// Read deadline of the links whose reads wait on channels, the zero value
+// has none
+type readDeadline struct {
+	mu       sync.Mutex
+	deadline time.Time
+	changed  chan struct{} //Closed when the deadline changes
+}
+
+func (d *readDeadline) set(t time.Time) {
+	d.mu.Lock()
+	d.deadline = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+}
+
+// Channels to select on for one wait: timeout fires at the deadline, changed
+// is closed when it moves. stop must be called once the wait is over.
+func (d *readDeadline) wait() (timeout <-chan time.Time, changed <-chan struct{}, stop func(), expired bool) {
+	d.mu.Lock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	deadline := d.deadline
+	changed = d.changed
+	d.mu.Unlock()
+
+	if deadline.IsZero() {
+		return nil, changed, func() {}, false
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return nil, changed, func() {}, true
+	}
+	timer := time.NewTimer(wait)
+	return timer.C, changed, func() { timer.Stop() }, false
+}
+
+// Implemented by the links shared by the whole stack, which deliver the
+// segments to their endpoints by port
+type portBinder interface {
+	bindPorts(localPort, remotePort uint16)
+}
+
+// Binds conn to the ports of its connection if its link needs them,
+// remotePort is 0 for a listener
+func bindPorts(conn IPConn, localPort, remotePort uint16) {
+	if b, ok := conn.(portBinder); ok {
+		b.bindPorts(localPort, remotePort)
+	}
+}
+
+// Implemented by the links read through several queues in parallel
+type MultiQueueLink interface {
+	LinkConn
+	NumQueues() int
+	ReadQueueFrom(queue int, b []byte) (n int, addr *net.IPAddr, ecn uint8, err error)
+}
+
+// Hash of a flow, by remote address and port and local port
+func flowHash(remoteIP uint32, remotePort, localPort uint16) uint32 {
+	hash := uint32(2166136261) //FNV-1a
+	for _, v := range []uint32{remoteIP >> 16, remoteIP & 0xffff, uint32(remotePort), uint32(localPort)} {
+		hash = (hash ^ v) * 16777619
+	}
+	return hash
+}
+
+// Opens the link of a connection, remoteAddr is nil for a listener
+type LinkOpener func(localAddr, remoteAddr *net.IPAddr) (LinkConn, error)
+
+// Device moving whole IP packets, used to forward them between interfaces
+type PacketDevice interface {
+	ReadPacket(b []byte) (n int, err error)
+	WritePacket(b []byte) (n int, err error)
+	Close() error
+}
+
+type filePacketDevice struct {
+	name string
+	file *os.File
+}
+
+func (d *filePacketDevice) ReadPacket(b []byte) (n int, err error) {
+	return d.file.Read(b)
+}
+
+func (d *filePacketDevice) WritePacket(b []byte) (n int, err error) {
+	return d.file.Write(b)
+}
+
+func (d *filePacketDevice) Close() error {
+	detachTun(d.name)
+	return d.file.Close()
+}
+
+// Opens the TUN device name for forwarding, exclusively: it fails with a
+// *TunInUseError while the stack has the device open and the stack cannot
+// open it while it is forwarded, a router never takes the flows of local
+// connections
+func TunPacketDevice(name string) func() (PacketDevice, error) {
+	return func() (PacketDevice, error) {
+		if err := attachTun(name); err != nil {
+			return nil, err
+		}
+		file, err := openTunRawDevice(name)
+		if errors.Is(err, syscall.EBUSY) {
+			err = &TunInUseError{name}
+		}
+		if err != nil {
+			detachTun(name)
+			return nil, err
+		}
+		return &filePacketDevice{name, file}, nil
+	}
+}
+
+// TUN device tun11
+func OpenTun(localAddr, remoteAddr *net.IPAddr) (LinkConn, error) {
+	return TunQueues(1)(localAddr, remoteAddr)
+}
+
+// TUN device tun11 opened with n queues (Linux). Meant for listeners, which
+// read every queue with a goroutine each, a dialed connection always opens a
+// single one. The device is not shared, see TunDevice.
+func TunQueues(n int) LinkOpener {
+	return TunDevice("tun11", n)
+}
+
+// TUN device name opened with n queues, to attach several of them. The
+// device is owned by the first connection or listener that opens it, the
+// flows are not demultiplexed between several of them: a second dial or a
+// listener on the same device fails with a *TunInUseError. A listener
+// accepts any number of connections on its device.
+func TunDevice(name string, n int) LinkOpener {
+	return func(localAddr, remoteAddr *net.IPAddr) (LinkConn, error) {
+		queues := n
+		if remoteAddr != nil {
+			queues = 1 //The kernel could steer the flow to a queue it does not read
+		}
+		conn, err := openTunIPConn(name, localAddr, remoteAddr, queues)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
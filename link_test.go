@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Reads blocked on a channel must return as soon as the deadline is moved,
+// not at the next poll
+func testReadDeadline(t *testing.T, conn IPConn) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 100))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatal("read returned without a deadline:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	start := time.Now()
+	setReadDeadline(conn, time.Now())
+	select {
+	case err := <-done:
+		if err != ErrReadTimeout {
+			t.Fatal("read error", err)
+		}
+		if wait := time.Since(start); wait > 100*time.Millisecond {
+			t.Error("read interrupted after", wait)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not interrupted by the deadline")
+	}
+
+	setReadDeadline(conn, time.Now().Add(20*time.Millisecond))
+	if _, err := conn.Read(make([]byte, 100)); err != ErrReadTimeout {
+		t.Fatal("read error", err)
+	}
+
+	setReadDeadline(conn, time.Time{})
+	go func() {
+		_, err := conn.Read(make([]byte, 100))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatal("read error after Close", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not interrupted by Close")
+	}
+}
+
+func TestListenerIPConnReadDeadline(t *testing.T) {
+	listener, err := ListenLink(OpenLoopback, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 7044)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	testReadDeadline(t, &listenerIPConn{
+		listener: listener,
+		in:       make(chan listenerSegment),
+		closed:   make(chan struct{})})
+}
+
+func TestEthernetIPConnReadDeadline(t *testing.T) {
+	device, peer := net.Pipe()
+	defer peer.Close()
+	localAddr := &net.IPAddr{IP: net.IPv4(10, 44, 0, 1)}
+	remoteAddr := &net.IPAddr{IP: net.IPv4(10, 44, 0, 2)}
+
+	testReadDeadline(t, NewEthernetIPConn(device, randomHardwareAddr(), localAddr, remoteAddr))
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultBacklog = 16
+
+type connKey struct {
+	remoteIp   uint32
+	remotePort uint16
+}
+
+// Passive side: the listener owns the device and dispatches the segments
+// to its connections by remote address and port.
+type TeaCPListener struct {
+	ipConn    LinkConn
+	loopback  LinkConn //Connections from the stack itself, nil if ipConn is the loopback
+	localAddr *net.IPAddr
+	port      uint16
+	mtu       int //MTU of ipConn, 0 if unknown
+
+	mu         sync.Mutex
+	conns      map[connKey]*listenerIPConn
+	handshakes map[*listenerIPConn]context.CancelFunc //In progress
+	waiting    int                                    //AcceptContext calls
+	accepted   chan *TeaCPConn
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// IPConn of a connection accepted by a listener
+type listenerIPConn struct {
+	listener   *TeaCPListener
+	link       LinkConn //Link the connection was received on
+	key        connKey
+	remoteAddr *net.IPAddr
+	in         chan listenerSegment
+	deadline   readDeadline
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+type listenerSegment struct {
+	data []byte
+	ecn  uint8
+}
+
+// Listens on the interface of DefaultRoutes owning localAddr, the TUN
+// device if none does
+func ListenTeaCP(localAddr *net.IPAddr, port int) (*TeaCPListener, error) {
+	ifc := DefaultRoutes.InterfaceOf(localAddr.IP)
+	if ifc == nil {
+		return ListenLink(OpenTun, localAddr, port)
+	}
+	return listen(ifc.Link, ifc.MTU, localAddr, port)
+}
+
+// Listens on the link opened by openLink, such as TapLink. Every queue of
+// a MultiQueueLink (TunQueues) is read by its own goroutine.
+func ListenLink(openLink LinkOpener, localAddr *net.IPAddr, port int) (*TeaCPListener, error) {
+	return listen(openLink, 0, localAddr, port)
+}
+
+func listen(openLink LinkOpener, mtu int, localAddr *net.IPAddr, port int) (*TeaCPListener, error) {
+	ipConn, err := openLink(localAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	bindPorts(ipConn, uint16(port), 0)
+
+	var loopback LinkConn
+	if _, ok := ipConn.(*LoopbackIPConn); !ok {
+		loopback, _ = OpenLoopback(localAddr, nil)
+		bindPorts(loopback, uint16(port), 0)
+	}
+
+	l := &TeaCPListener{
+		ipConn:     ipConn,
+		loopback:   loopback,
+		localAddr:  localAddr,
+		port:       uint16(port),
+		mtu:        mtu,
+		conns:      make(map[connKey]*listenerIPConn),
+		handshakes: make(map[*listenerIPConn]context.CancelFunc),
+		accepted:   make(chan *TeaCPConn, defaultBacklog),
+		closed:     make(chan struct{})}
+
+	go l.receiver()
+	return l, nil
+}
+
+func (l *TeaCPListener) Accept() (*TeaCPConn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// Waits for a connection whose handshake is complete. When ctx is done and
+// no other call is waiting, the handshakes in progress are aborted: their
+// peers get a RST and their state is released. Connections already
+// established stay queued for the next call.
+func (l *TeaCPListener) AcceptContext(ctx context.Context) (*TeaCPConn, error) {
+	l.mu.Lock()
+	l.waiting++
+	l.mu.Unlock()
+
+	select {
+	case conn := <-l.accepted:
+		l.stopWaiting(false)
+		return conn, nil
+	case <-l.closed:
+		l.stopWaiting(false)
+		return nil, &net.OpError{Op: "accept", Net: "teacp", Addr: l.localAddr, Err: net.ErrClosed}
+	case <-ctx.Done():
+		l.stopWaiting(true)
+		return nil, &net.OpError{Op: "accept", Net: "teacp", Addr: l.localAddr, Err: ctx.Err()}
+	}
+}
+
+func (l *TeaCPListener) stopWaiting(cancelled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waiting--
+	if cancelled && l.waiting == 0 {
+		for _, cancel := range l.handshakes {
+			cancel()
+		}
+	}
+}
+
+func (l *TeaCPListener) Addr() net.Addr {
+	return l.localAddr
+}
+
+// Stops listening: the handshakes in progress and the connections not
+// accepted yet are aborted
+func (l *TeaCPListener) Close() error {
+	l.closeOnce.Do(func() {
+		//Reset while the link is still open, then nothing is queued anymore
+		l.mu.Lock()
+		for len(l.accepted) > 0 {
+			(<-l.accepted).Abort()
+		}
+		close(l.closed)
+		l.mu.Unlock()
+
+		setReadDeadline(l.ipConn, time.Now()) //Wakes up the receiver
+		if l.loopback != nil {
+			setReadDeadline(l.loopback, time.Now())
+		}
+	})
+	return nil
+}
+
+func (l *TeaCPListener) receiver() {
+	fmt.Println("L: listening on port", l.port)
+
+	queues := 1
+	multiQueue, ok := l.ipConn.(MultiQueueLink)
+	if ok {
+		queues = multiQueue.NumQueues()
+	}
+
+	//Segments are spread over the workers by flow, so that each connection
+	//keeps receiving them in order
+	workers := make([]chan listenerPacket, queues)
+	var workersDone sync.WaitGroup
+	for i := range workers {
+		workers[i] = make(chan listenerPacket, 64)
+		workersDone.Add(1)
+		go func(in chan listenerPacket) {
+			defer workersDone.Done()
+			for p := range in {
+				l.dispatch(p)
+			}
+		}(workers[i])
+	}
+
+	var readersDone sync.WaitGroup
+	read := func(link LinkConn, read func(b []byte) (int, *net.IPAddr, uint8, error)) {
+		readersDone.Add(1)
+		go func() {
+			defer readersDone.Done()
+			l.readQueue(link, read, workers)
+		}()
+	}
+	for queue := 0; queue < queues; queue++ {
+		if multiQueue != nil {
+			q := queue
+			read(l.ipConn, func(b []byte) (int, *net.IPAddr, uint8, error) {
+				return multiQueue.ReadQueueFrom(q, b)
+			})
+		} else {
+			read(l.ipConn, l.ipConn.ReadFromECN)
+		}
+	}
+	if l.loopback != nil {
+		read(l.loopback, l.loopback.ReadFromECN)
+	}
+
+	readersDone.Wait()
+	for _, in := range workers {
+		close(in)
+	}
+	workersDone.Wait()
+	l.ipConn.Close()
+	if l.loopback != nil {
+		l.loopback.Close()
+	}
+	fmt.Println("L: listener stopped")
+}
+
+// Packet read by a queue, waiting for its worker
+type listenerPacket struct {
+	link   LinkConn
+	packet *TCPPacket
+	data   []byte
+	addr   *net.IPAddr
+	ecn    uint8
+}
+
+func (l *TeaCPListener) readQueue(link LinkConn, read func(b []byte) (int, *net.IPAddr, uint8, error), workers []chan listenerPacket) {
+	buffer := make([]byte, 65535) //Reused, a worker gets a copy of the packet
+	for {
+		select {
+		case <-l.closed:
+			return
+		default:
+		}
+
+		n, addr, ecn, err := read(buffer)
+		if unreachable, ok := err.(*ICMPUnreachableError); ok {
+			fmt.Println("L: ", unreachable)
+			continue
+		}
+		if err != nil {
+			if err != ErrReadTimeout {
+				fmt.Println("L: IP Read error", err)
+			}
+			continue
+		}
+
+		data := append([]byte(nil), buffer[:n]...)
+		packet := NewTCPPacket(data)
+		hash := flowHash(IPV4AddrToInt(addr.IP.String()), packet.SrcPort, packet.DestPort)
+		workers[hash%uint32(len(workers))] <- listenerPacket{link, packet, data, addr, ecn}
+	}
+}
+
+// Hands a segment to its connection, answers it with a RST or starts the
+// handshake of a new connection
+func (l *TeaCPListener) dispatch(p listenerPacket) {
+	packet, addr := p.packet, p.addr
+	key := connKey{IPV4AddrToInt(addr.IP.String()), packet.SrcPort}
+
+	l.mu.Lock()
+	conn := l.conns[key]
+	l.mu.Unlock()
+
+	if conn != nil && packet.DestPort == l.port {
+		select {
+		case conn.in <- listenerSegment{p.data, p.ecn}:
+		default:
+			fmt.Println("L: connection queue full, segment dropped")
+		}
+		return
+	}
+
+	if packet.HasFlag(FlagRST) {
+		return
+	}
+	if packet.DestPort != l.port || !packet.HasFlag(FlagSYN) || packet.HasFlag(FlagACK) {
+		reset := resetFor(packet)
+		p.link.WriteToECN(reset.Marshall(l.localAddr.String(), addr.IP.String()), addr, ECNNotECT)
+		return
+	}
+
+	if len(l.accepted) == cap(l.accepted) {
+		fmt.Println("L: backlog full, SYN dropped")
+		return
+	}
+
+	conn = &listenerIPConn{
+		listener:   l,
+		link:       p.link,
+		key:        key,
+		remoteAddr: addr,
+		in:         make(chan listenerSegment, 64),
+		closed:     make(chan struct{})}
+	l.mu.Lock()
+	l.conns[key] = conn
+	l.mu.Unlock()
+
+	go l.accept(conn, packet)
+}
+
+func (l *TeaCPListener) accept(ipConn *listenerIPConn, syn *TCPPacket) {
+	mtu := l.mtu
+	if _, ok := ipConn.link.(*LoopbackIPConn); ok {
+		mtu = loopbackMTU
+	}
+	t := &TeaCPConn{
+		ipConn:       ipConn,
+		mtu:          mtu,
+		localIPAddr:  l.localAddr,
+		remoteIPAddr: ipConn.remoteAddr,
+		sourcePort:   l.port,
+		destPort:     syn.SrcPort}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l.mu.Lock()
+	l.handshakes[ipConn] = cancel
+	l.mu.Unlock()
+	go func() {
+		select {
+		case <-l.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := t.accept(ctx, syn)
+	l.mu.Lock()
+	delete(l.handshakes, ipConn)
+	l.mu.Unlock()
+	if err != nil {
+		fmt.Println("L: handshake with", ipConn.remoteAddr, "failed:", err)
+		return
+	}
+
+	//Queued under mu, Close either sees the connection or is seen first
+	l.mu.Lock()
+	queued := false
+	select {
+	case <-l.closed:
+	default:
+		select {
+		case l.accepted <- t:
+			queued = true
+		default:
+			fmt.Println("L: backlog full, connection reset")
+		}
+	}
+	l.mu.Unlock()
+	if !queued {
+		t.Abort()
+	}
+}
+
+func (c *listenerIPConn) Read(b []byte) (n int, err error) {
+	n, _, err = c.ReadECN(b)
+	return n, err
+}
+
+// Blocks until the listener hands over a segment, the deadline or Close
+func (c *listenerIPConn) ReadECN(b []byte) (n int, ecn uint8, err error) {
+	for {
+		timeout, changed, stop, expired := c.deadline.wait()
+		if expired {
+			return -1, 0, ErrReadTimeout
+		}
+
+		select {
+		case segment := <-c.in:
+			stop()
+			return copy(b, segment.data), segment.ecn, nil
+		case <-c.closed:
+			stop()
+			return -1, 0, net.ErrClosed
+		case <-timeout:
+			return -1, 0, ErrReadTimeout
+		case <-changed:
+			stop() //New deadline
+		}
+	}
+}
+
+func (c *listenerIPConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *listenerIPConn) ReadBatch(segments []Segment) (n int, err error) {
+	if len(segments) == 0 {
+		return 0, nil
+	}
+	length, ecn, err := c.ReadECN(segments[0].Data[:cap(segments[0].Data)])
+	if err != nil {
+		return 0, err
+	}
+	segments[0].Data = segments[0].Data[:length]
+	segments[0].ECN = ecn
+
+	for n = 1; n < len(segments); n++ {
+		select {
+		case segment := <-c.in:
+			buffer := segments[n].Data[:cap(segments[n].Data)]
+			segments[n].Data = buffer[:copy(buffer, segment.data)]
+			segments[n].ECN = segment.ecn
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+func (c *listenerIPConn) WriteBatch(segments []Segment) (n int, err error) {
+	select {
+	case <-c.listener.closed:
+		return 0, syscall.EPIPE
+	default:
+	}
+	if link, ok := c.link.(BatchLink); ok {
+		return link.WriteBatchTo(segments, c.remoteAddr)
+	}
+	for n = range segments {
+		if _, err = c.WriteECN(segments[n].Data, segments[n].ECN); err != nil {
+			return n, err
+		}
+	}
+	return len(segments), nil
+}
+
+func (c *listenerIPConn) Write(b []byte) (n int, err error) {
+	return c.WriteECN(b, ECNNotECT)
+}
+
+func (c *listenerIPConn) WriteECN(b []byte, ecn uint8) (n int, err error) {
+	select {
+	case <-c.listener.closed:
+		return -1, syscall.EPIPE
+	default:
+	}
+	return c.link.WriteToECN(b, c.remoteAddr, ecn)
+}
+
+func (c *listenerIPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.listener.mu.Lock()
+		delete(c.listener.conns, c.key)
+		c.listener.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *listenerIPConn) LocalAddr() net.IPAddr {
+	return *c.listener.localAddr
+}
+
+func (c *listenerIPConn) RemoteAddr() net.IPAddr {
+	return *c.remoteAddr
+}
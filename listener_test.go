@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Client endpoint driven by hand over the loopback interface
+func rawLoopbackClient(t *testing.T, clientAddr, serverAddr *net.IPAddr, localPort, remotePort uint16) LinkConn {
+	client, err := OpenLoopback(clientAddr, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	bindPorts(client, localPort, remotePort)
+	return client
+}
+
+func readSegment(t *testing.T, conn LinkConn) *TCPPacket {
+	setReadDeadline(conn, time.Now().Add(2*time.Second))
+	b := make([]byte, 65535)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTCPPacket(b[:n])
+}
+
+func (l *TeaCPListener) pending() (conns, handshakes int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns), len(l.handshakes)
+}
+
+// The handshake in progress when the only Accept gives up is reset and
+// forgotten
+func TestAcceptContextCancelAbortsHandshake(t *testing.T) {
+	serverAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	clientAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 34)}
+	listener, err := ListenLink(OpenLoopback, serverAddr, 7034)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client := rawLoopbackClient(t, clientAddr, serverAddr, 40034, 7034)
+
+	syn := &TCPPacket{SrcPort: 40034, DestPort: 7034, SeqNum: 1000, DataOffset: 5, WindowSize: 65535}
+	syn.SetFlag(FlagSYN)
+	if _, err := client.Write(syn.Marshall(clientAddr.IP.String(), serverAddr.IP.String())); err != nil {
+		t.Fatal(err)
+	}
+	synAck := readSegment(t, client)
+	if !synAck.HasFlag(FlagSYN) || !synAck.HasFlag(FlagACK) {
+		t.Fatal("no SYN+ACK:", synAck)
+	}
+	if _, handshakes := listener.pending(); handshakes != 1 {
+		t.Fatal(handshakes, "handshakes in progress")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := listener.AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("accept:", err)
+	}
+
+	reset := readSegment(t, client)
+	if !reset.HasFlag(FlagRST) || reset.SeqNum != synAck.SeqNum+1 {
+		t.Fatal("handshake not reset:", reset)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conns, handshakes := listener.pending(); conns == 0 && handshakes == 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("handshake state not released")
+		}
+	}
+}
+
+// Connections established but never accepted are reset by Close
+func TestListenerCloseAbortsQueued(t *testing.T) {
+	serverAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, err := ListenLink(OpenLoopback, serverAddr, 7134)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &Dialer{LocalAddr: &net.IPAddr{IP: net.IPv4(127, 0, 0, 35)}, KeepAlive: -1, Link: OpenLoopback}
+	conn, err := dialer.DialContext(ctx, serverAddr, 7134)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Abort()
+	for start := time.Now(); len(listener.accepted) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("connection not queued")
+		}
+	}
+
+	listener.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatal("read:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued connection not reset")
+	}
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("accept after Close:", err)
+	}
+}
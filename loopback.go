@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Loopback interface of the stack: the packets written by an endpoint are
+// delivered to the input of the endpoint they are addressed to, without any
+// device.
+type loopbackHub struct {
+	mu        sync.Mutex
+	endpoints map[*LoopbackIPConn]bool
+}
+
+var loopback = &loopbackHub{endpoints: make(map[*LoopbackIPConn]bool)}
+
+// IPConn of the loopback interface. A connection is bound to its ports by
+// bindPorts, a listener to its local port only.
+type LoopbackIPConn struct {
+	localAddr  *net.IPAddr
+	remoteAddr *net.IPAddr
+	srcField   uint32
+	dstField   uint32
+
+	mu         sync.Mutex
+	localPort  uint16
+	remotePort uint16
+	deadline   readDeadline
+
+	in        chan loopbackPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type loopbackPacket struct {
+	data []byte //Whole IP packet
+}
+
+// Opens an endpoint on the loopback interface, remoteAddr is nil for a
+// listener
+func OpenLoopback(localAddr, remoteAddr *net.IPAddr) (LinkConn, error) {
+	c := &LoopbackIPConn{
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		srcField:   IPV4AddrToInt(localAddr.IP.String()),
+		in:         make(chan loopbackPacket, 256),
+		closed:     make(chan struct{})}
+	if remoteAddr != nil {
+		c.dstField = IPV4AddrToInt(remoteAddr.IP.String())
+	}
+
+	loopback.mu.Lock()
+	loopback.endpoints[c] = true
+	loopback.mu.Unlock()
+	return c, nil
+}
+
+// True if a listener of the stack is on addr
+func (h *loopbackHub) ownAddr(addr uint32) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.endpoints {
+		if c.srcField == addr && c.remoteAddr == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivers an IP packet carrying a TCP segment: to the connection bound to
+// its addresses and ports first, then to a listener on its destination. A
+// segment nobody listens for is answered with a RST.
+func (h *loopbackHub) deliver(data []byte) {
+	packet := NewIPV4Packet(data)
+	segment := NewTCPPacket(packet.Payload)
+
+	h.mu.Lock()
+	var target *LoopbackIPConn
+	for c := range h.endpoints {
+		c.mu.Lock()
+		localPort, remotePort := c.localPort, c.remotePort
+		c.mu.Unlock()
+
+		if c.srcField != packet.DstIp || localPort != segment.DestPort {
+			continue
+		}
+		if c.remoteAddr == nil {
+			if target == nil {
+				target = c
+			}
+		} else if c.dstField == packet.SrcIp && remotePort == segment.SrcPort {
+			target = c
+			break
+		}
+	}
+	h.mu.Unlock()
+
+	if target != nil {
+		select {
+		case target.in <- loopbackPacket{data}:
+		case <-target.closed:
+		default:
+			//Dropped as a full device queue would
+		}
+		return
+	}
+
+	if segment.HasFlag(FlagRST) {
+		return
+	}
+	reset := resetFor(segment)
+	src, dst := DecodeIPV4Addr(packet.DstIp), DecodeIPV4Addr(packet.SrcIp)
+	h.deliver(newTCPIPV4Packet(packet.DstIp, packet.SrcIp, ECNNotECT, reset.Marshall(src, dst)).Serialize())
+}
+
+// Segments are only delivered to the endpoint once bound. remotePort is 0
+// for a listener.
+func (c *LoopbackIPConn) bindPorts(localPort, remotePort uint16) {
+	c.mu.Lock()
+	c.localPort = localPort
+	c.remotePort = remotePort
+	c.mu.Unlock()
+}
+
+func (c *LoopbackIPConn) RemoteAddr() net.IPAddr {
+	return *c.remoteAddr
+}
+
+func (c *LoopbackIPConn) LocalAddr() net.IPAddr {
+	return *c.localAddr
+}
+
+// Pending reads return os.ErrClosed
+func (c *LoopbackIPConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		loopback.mu.Lock()
+		delete(loopback.endpoints, c)
+		loopback.mu.Unlock()
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *LoopbackIPConn) Write(data []byte) (n int, err error) {
+	return c.write(data, c.dstField, ECNNotECT)
+}
+
+func (c *LoopbackIPConn) WriteECN(data []byte, ecn uint8) (n int, err error) {
+	return c.write(data, c.dstField, ecn)
+}
+
+func (c *LoopbackIPConn) WriteToECN(data []byte, addr *net.IPAddr, ecn uint8) (n int, err error) {
+	return c.write(data, IPV4AddrToInt(addr.IP.String()), ecn)
+}
+
+func (c *LoopbackIPConn) write(data []byte, dst uint32, ecn uint8) (n int, err error) {
+	select {
+	case <-c.closed:
+		return -1, os.ErrClosed
+	default:
+	}
+	loopback.deliver(newTCPIPV4Packet(c.srcField, dst, ecn, data).Serialize())
+	return len(data), nil
+}
+
+func (c *LoopbackIPConn) Read(b []byte) (n int, err error) {
+	n, _, _, err = c.ReadFromECN(b)
+	return n, err
+}
+
+func (c *LoopbackIPConn) ReadECN(b []byte) (n int, ecn uint8, err error) {
+	n, _, ecn, err = c.ReadFromECN(b)
+	return n, ecn, err
+}
+
+// Blocks until a packet is delivered, the deadline or Close
+func (c *LoopbackIPConn) ReadFromECN(b []byte) (n int, addr *net.IPAddr, ecn uint8, err error) {
+	for {
+		timeout, changed, stop, expired := c.deadline.wait()
+		if expired {
+			return -1, nil, 0, ErrReadTimeout
+		}
+
+		var p loopbackPacket
+		select {
+		case p = <-c.in:
+		case <-c.closed:
+			err = os.ErrClosed
+		case <-timeout:
+			err = ErrReadTimeout
+		case <-changed:
+		}
+		stop()
+		if err != nil {
+			return -1, nil, 0, err
+		}
+		if p.data == nil {
+			continue //New deadline
+		}
+
+		packet := NewIPV4Packet(p.data)
+		ok, err := acceptIPV4Packet(packet, c.srcField)
+		if err != nil {
+			return -1, nil, 0, err
+		}
+		if ok {
+			return copy(b, packet.Payload), &net.IPAddr{IP: net.ParseIP(DecodeIPV4Addr(packet.SrcIp))}, packet.ECN, nil
+		}
+	}
+}
+
+func (c *LoopbackIPConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+type NATKind int
+
+const (
+	SNAT       NATKind = iota //Source rewritten to ToAddr
+	DNAT                      //Destination rewritten to ToAddr and ToPort
+	Masquerade                //Source rewritten to the address of the egress interface
+)
+
+// Rule applied to the first packet of a flow. The nil or zero match fields
+// match anything.
+type NATRule struct {
+	Kind         NATKind
+	Protocol     uint8
+	Src          *net.IPNet
+	Dst          *net.IPNet
+	DstPort      uint16
+	InInterface  string //DNAT only
+	OutInterface string //SNAT and Masquerade only
+
+	ToAddr net.IP
+	ToPort uint16 //DNAT, 0 keeps the port
+}
+
+// Connection tracking NAT for TCP, UDP and ICMP echo, applied by a Router.
+// The translations are kept in the flows of its conntrack table. Tracking
+// is liberal like without NAT: a TCP segment outside the window is counted
+// as invalid but still translated and forwarded.
+type NAT struct {
+	ct *Conntrack
+
+	mu    sync.Mutex
+	rules []NATRule
+}
+
+// NAT tracking its flows in ct, a new table if nil
+func NewNAT(ct *Conntrack) *NAT {
+	if ct == nil {
+		ct = NewConntrack()
+	}
+	return &NAT{ct: ct}
+}
+
+// Rules are evaluated in order, the first matching DNAT rule and the first
+// matching SNAT or Masquerade rule are applied.
+func (n *NAT) AddRule(rule NATRule) {
+	n.mu.Lock()
+	n.rules = append(n.rules, rule)
+	n.mu.Unlock()
+}
+
+func (n *NAT) getRules() []NATRule {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rules
+}
+
+// Table holding the flows of the NAT
+func (n *NAT) Conntrack() *Conntrack {
+	return n.ct
+}
+
+// Translates a packet of a known flow, or applies the DNAT rules to the
+// first packet of a new one, which is returned to be confirmed by
+// postrouting. Returns false if the packet must be dropped.
+func (n *NAT) prerouting(packet []byte, in *Interface) (*conntrackEntry, bool) {
+	headerLen := int(packet[0]&0xf) * 4
+	field := binary.BigEndian.Uint16(packet[6:])
+	if field&ipFragOffsetMask != 0 {
+		//No transport header to find the flow, fragments are not reassembled
+		fmt.Println("R: fragment dropped by NAT")
+		return nil, false
+	}
+	rules := n.getRules()
+
+	ct := n.ct
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	now := time.Now()
+	ct.sweep(now)
+
+	tuple, ok := parseConntrackTuple(packet)
+	if !ok {
+		if packet[9] == ProtocolICMP {
+			n.translateICMPError(packet, headerLen)
+		}
+		return nil, true
+	}
+
+	if entry, reply := ct.lookup(tuple); entry != nil {
+		if entry.translated() {
+			if reply {
+				natRewrite(packet, entry.orig.reverse())
+			} else {
+				natRewrite(packet, entry.reply.reverse())
+			}
+		}
+		ct.update(entry, reply, packet, now) //Out of window segments are counted, not dropped
+		return nil, true
+	}
+
+	entry := &conntrackEntry{orig: tuple, reply: tuple.reverse()}
+	for _, rule := range rules {
+		if rule.Kind == DNAT && rule.matches(tuple) && (rule.InInterface == "" || rule.InInterface == in.Name) {
+			entry.reply.src = IPV4AddrToInt(rule.ToAddr.String())
+			if rule.ToPort != 0 && tuple.protocol != ProtocolICMP {
+				entry.reply.srcPort = rule.ToPort
+			}
+			natRewrite(packet, entry.reply.reverse())
+			break
+		}
+	}
+	return entry, true
+}
+
+// Applies the SNAT and Masquerade rules to the first packet of a flow once
+// its egress interface is known, and adds the flow to the conntrack table.
+// Returns false if no port is available.
+func (n *NAT) postrouting(packet []byte, entry *conntrackEntry, out *Interface) bool {
+	if entry == nil {
+		return true
+	}
+	rules := n.getRules()
+
+	for _, rule := range rules {
+		if rule.Kind == DNAT || !rule.matches(entry.orig) || (rule.OutInterface != "" && rule.OutInterface != out.Name) {
+			continue
+		}
+		to := rule.ToAddr
+		if rule.Kind == Masquerade {
+			to = sourceAddr(out, net.ParseIP(DecodeIPV4Addr(entry.reply.src)))
+		}
+		if to == nil {
+			return false
+		}
+		entry.reply.dst = IPV4AddrToInt(to.String())
+		break
+	}
+
+	ct := n.ct
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if entry.translated() && !n.allocatePort(entry) {
+		fmt.Println("R: no NAT port available for", DecodeIPV4Addr(entry.reply.dst))
+		return false
+	}
+	if ct.used(entry.orig) || ct.used(entry.reply) {
+		return true //Confirmed meanwhile by another packet, left untracked
+	}
+
+	ct.insert(entry)
+	if entry.translated() {
+		natRewrite(packet, entry.reply.reverse())
+	}
+	ct.update(entry, false, packet, time.Now()) //Out of window segments are counted, not dropped
+	return true
+}
+
+// Keeps the original port if the reply tuple is free, picks a random one
+// otherwise. Must be called with the conntrack mu held
+func (n *NAT) allocatePort(entry *conntrackEntry) bool {
+	if !n.ct.used(entry.reply) {
+		return true
+	}
+	for i := 0; i < 1024; i++ {
+		port := uint16(1024 + rand.Intn(65536-1024))
+		entry.reply.dstPort = port
+		if entry.orig.protocol == ProtocolICMP {
+			entry.reply.srcPort = port //Echo identifier
+		}
+		if !n.ct.used(entry.reply) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *NATRule) matches(t conntrackTuple) bool {
+	if r.Protocol != 0 && r.Protocol != t.protocol {
+		return false
+	}
+	if r.Src != nil && !r.Src.Contains(net.ParseIP(DecodeIPV4Addr(t.src))) {
+		return false
+	}
+	if r.Dst != nil && !r.Dst.Contains(net.ParseIP(DecodeIPV4Addr(t.dst))) {
+		return false
+	}
+	return r.DstPort == 0 || (t.protocol != ProtocolICMP && r.DstPort == t.dstPort)
+}
+
+// Translates an ICMP error about a packet of a tracked flow: the quoted
+// header is rewritten back as well as the destination of the error.
+// Must be called with the conntrack mu held
+func (n *NAT) translateICMPError(packet []byte, headerLen int) {
+	icmp := packet[headerLen:]
+	if len(icmp) < 8+20 {
+		return
+	}
+	switch icmp[0] {
+	case ICMPTypeDestUnreachable, ICMPTypeTimeExceeded:
+	default:
+		return
+	}
+
+	quoted := icmp[8:]
+	quotedLen := int(quoted[0]&0xf) * 4
+	if quotedLen < 20 || len(quoted) < quotedLen+8 {
+		return
+	}
+	inner, ok := parseConntrackTuple(quoted)
+	if !ok {
+		return
+	}
+	//The quoted packet went the other way
+	entry, reply := n.ct.lookup(inner.reverse())
+	if entry == nil || !entry.translated() {
+		return
+	}
+	translated := entry.reply.reverse()
+	if reply {
+		translated = entry.orig.reverse()
+	}
+	translated = translated.reverse()
+
+	natRewrite(quoted, translated)
+
+	outer := conntrackTuple{protocol: ProtocolICMP, src: binary.BigEndian.Uint32(packet[12:]), dst: translated.src}
+	natRewrite(packet, outer)
+	binary.BigEndian.PutUint16(icmp[2:], 0)
+	binary.BigEndian.PutUint16(icmp[2:], icmpChecksum(icmp))
+}
+
+func icmpChecksum(icmp []byte) uint16 {
+	if len(icmp)%2 != 0 {
+		return ipChecksum(append(append([]byte{}, icmp...), 0))
+	}
+	return ipChecksum(icmp)
+}
+
+// Rewrites the addresses and ports of a packet to the tuple, the checksums
+// are updated incrementally.
+func natRewrite(packet []byte, t conntrackTuple) {
+	headerLen := int(packet[0]&0xf) * 4
+	oldSrc := binary.BigEndian.Uint32(packet[12:])
+	oldDst := binary.BigEndian.Uint32(packet[16:])
+
+	ipSum := binary.BigEndian.Uint16(packet[10:])
+	ipSum = checksumUpdate32(ipSum, oldSrc, t.src)
+	ipSum = checksumUpdate32(ipSum, oldDst, t.dst)
+	binary.BigEndian.PutUint16(packet[10:], ipSum)
+	binary.BigEndian.PutUint32(packet[12:], t.src)
+	binary.BigEndian.PutUint32(packet[16:], t.dst)
+
+	l4 := packet[headerLen:]
+	switch packet[9] {
+	case ProtocolTCP, ProtocolUDP:
+		sumOffset := 16
+		if packet[9] == ProtocolUDP {
+			sumOffset = 6
+		}
+		if len(l4) < 4 {
+			return
+		}
+		oldSrcPort := binary.BigEndian.Uint16(l4)
+		oldDstPort := binary.BigEndian.Uint16(l4[2:])
+		binary.BigEndian.PutUint16(l4, t.srcPort)
+		binary.BigEndian.PutUint16(l4[2:], t.dstPort)
+
+		if len(l4) < sumOffset+2 {
+			return //Quoted by an ICMP error, without the checksum
+		}
+		sum := binary.BigEndian.Uint16(l4[sumOffset:])
+		if packet[9] == ProtocolUDP && sum == 0 {
+			return //No checksum
+		}
+		sum = checksumUpdate32(sum, oldSrc, t.src) //Pseudo header
+		sum = checksumUpdate32(sum, oldDst, t.dst)
+		sum = checksumUpdate(sum, oldSrcPort, t.srcPort)
+		sum = checksumUpdate(sum, oldDstPort, t.dstPort)
+		if packet[9] == ProtocolUDP && sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(l4[sumOffset:], sum)
+	case ProtocolICMP:
+		if len(l4) < 8 || (l4[0] != ICMPTypeEcho && l4[0] != ICMPTypeEchoReply) {
+			return
+		}
+		oldID := binary.BigEndian.Uint16(l4[4:])
+		binary.BigEndian.PutUint16(l4[4:], t.srcPort)
+		binary.BigEndian.PutUint16(l4[2:], checksumUpdate(binary.BigEndian.Uint16(l4[2:]), oldID, t.srcPort))
+	}
+}
+
+// Updates a checksum for a 16 bits word changing from old to updated
+// (RFC 1624 equation 3)
+func checksumUpdate(sum, old, updated uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(updated)
+	for (s >> 16) > 0 {
+		s = (s & 0xffff) + (s >> 16)
+	}
+	return ^uint16(s)
+}
+
+func checksumUpdate32(sum uint16, old, updated uint32) uint16 {
+	sum = checksumUpdate(sum, uint16(old>>16), uint16(updated>>16))
+	return checksumUpdate(sum, uint16(old), uint16(updated))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+var (
+	natLAN = &Interface{Name: "lan", Addrs: []*net.IPNet{{IP: net.IPv4(192, 168, 1, 1).To4(), Mask: net.CIDRMask(24, 32)}}, MTU: defaultMTU}
+	natWAN = &Interface{Name: "wan", Addrs: []*net.IPNet{{IP: net.IPv4(203, 0, 113, 1).To4(), Mask: net.CIDRMask(24, 32)}}, MTU: defaultMTU}
+)
+
+// IPv4 packet of protocol between the endpoints, the ports are the echo
+// identifier for ICMP. flags, seq and ack are only used by TCP.
+type testPacket struct {
+	protocol     uint8
+	src, dst     string
+	sport, dport uint16
+	flags        uint8
+	seq, ack     uint32
+	noUDPSum     bool
+	payload      []byte
+}
+
+func (p testPacket) build() []byte {
+	var l4 []byte
+	switch p.protocol {
+	case ProtocolTCP:
+		l4 = make([]byte, 20)
+		binary.BigEndian.PutUint16(l4, p.sport)
+		binary.BigEndian.PutUint16(l4[2:], p.dport)
+		binary.BigEndian.PutUint32(l4[4:], p.seq)
+		binary.BigEndian.PutUint32(l4[8:], p.ack)
+		l4[12] = 5 << 4
+		l4[tcpFlagsOffset] = p.flags
+		binary.BigEndian.PutUint16(l4[14:], 65535)
+	case ProtocolUDP:
+		l4 = make([]byte, 8)
+		binary.BigEndian.PutUint16(l4, p.sport)
+		binary.BigEndian.PutUint16(l4[2:], p.dport)
+		binary.BigEndian.PutUint16(l4[4:], uint16(8+len(p.payload)))
+	case ProtocolICMP:
+		l4 = make([]byte, 8)
+		l4[0] = ICMPTypeEcho
+		if p.flags != 0 {
+			l4[0] = p.flags //Echo reply or error
+		}
+		binary.BigEndian.PutUint16(l4[4:], p.sport)
+		binary.BigEndian.PutUint16(l4[6:], 1)
+	}
+	l4 = append(l4, p.payload...)
+
+	packet := make([]byte, 20, 20+len(l4))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(20+len(l4)))
+	binary.BigEndian.PutUint16(packet[4:], 0x1234)
+	packet[8] = 64
+	packet[9] = p.protocol
+	copy(packet[12:], net.ParseIP(p.src).To4())
+	copy(packet[16:], net.ParseIP(p.dst).To4())
+	packet = append(packet, l4...)
+	fillChecksums(packet, !p.noUDPSum)
+	return packet
+}
+
+// Computes the IP and transport checksums from scratch, a UDP checksum is
+// left at zero without udpSum
+func fillChecksums(packet []byte, udpSum bool) {
+	headerLen := int(packet[0]&0xf) * 4
+	packet[10], packet[11] = 0, 0
+	binary.BigEndian.PutUint16(packet[10:], ipChecksum(packet[:headerLen]))
+
+	l4 := packet[headerLen:]
+	switch packet[9] {
+	case ProtocolTCP, ProtocolUDP:
+		offset := 16
+		if packet[9] == ProtocolUDP {
+			offset = 6
+		}
+		l4[offset], l4[offset+1] = 0, 0
+		if packet[9] == ProtocolUDP && !udpSum {
+			return
+		}
+		pseudo := make([]byte, 12, 12+len(l4)+1)
+		copy(pseudo, packet[12:20])
+		pseudo[9] = packet[9]
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(l4)))
+		pseudo = append(pseudo, l4...)
+		if len(pseudo)%2 != 0 {
+			pseudo = append(pseudo, 0)
+		}
+		sum := ipChecksum(pseudo)
+		if packet[9] == ProtocolUDP && sum == 0 {
+			sum = 0xffff
+		}
+		binary.BigEndian.PutUint16(l4[offset:], sum)
+	case ProtocolICMP:
+		l4[2], l4[3] = 0, 0
+		binary.BigEndian.PutUint16(l4[2:], icmpChecksum(l4))
+	}
+}
+
+// The incrementally updated checksums must be those computed from scratch
+func checkChecksums(t *testing.T, what string, packet []byte) {
+	t.Helper()
+	headerLen := int(packet[0]&0xf) * 4
+	udpSum := packet[9] != ProtocolUDP || binary.BigEndian.Uint16(packet[headerLen+6:]) != 0
+	expected := append([]byte(nil), packet...)
+	fillChecksums(expected, udpSum)
+	if !bytes.Equal(packet, expected) {
+		t.Errorf("%s: checksums % x, want % x", what, checksumFields(packet), checksumFields(expected))
+	}
+}
+
+func checksumFields(packet []byte) []byte {
+	headerLen := int(packet[0]&0xf) * 4
+	offset := map[uint8]int{ProtocolTCP: 16, ProtocolUDP: 6, ProtocolICMP: 2}[packet[9]]
+	return append(append([]byte{}, packet[10:12]...), packet[headerLen+offset:headerLen+offset+2]...)
+}
+
+func checkTuple(t *testing.T, what string, packet []byte, want testPacket) {
+	t.Helper()
+	got, ok := parseConntrackTuple(packet)
+	if !ok {
+		t.Fatal(what, ": no tuple")
+	}
+	expected, _ := parseConntrackTuple(want.build())
+	if got != expected {
+		t.Errorf("%s: %s:%d -> %s:%d, want %s:%d -> %s:%d", what,
+			DecodeIPV4Addr(got.src), got.srcPort, DecodeIPV4Addr(got.dst), got.dstPort,
+			DecodeIPV4Addr(expected.src), expected.srcPort, DecodeIPV4Addr(expected.dst), expected.dstPort)
+	}
+}
+
+// Packet of a new flow received on in and forwarded to out
+func natForward(t *testing.T, nat *NAT, packet []byte, in, out *Interface) {
+	t.Helper()
+	entry, ok := nat.prerouting(packet, in)
+	if !ok || !nat.postrouting(packet, entry, out) {
+		t.Fatal("packet dropped by the NAT")
+	}
+}
+
+func TestNATTranslation(t *testing.T) {
+	snat := NATRule{Kind: SNAT, OutInterface: "wan", ToAddr: net.IPv4(203, 0, 113, 9)}
+	masquerade := NATRule{Kind: Masquerade, OutInterface: "wan"}
+	dnat := NATRule{Kind: DNAT, InInterface: "wan", Dst: &net.IPNet{IP: net.IPv4(203, 0, 113, 1), Mask: net.CIDRMask(32, 32)}, ToAddr: net.IPv4(192, 168, 1, 10), ToPort: 80}
+
+	for _, protocol := range []struct {
+		name     string
+		protocol uint8
+		noUDPSum bool
+	}{{"tcp", ProtocolTCP, false}, {"udp", ProtocolUDP, false}, {"udp-nosum", ProtocolUDP, true}, {"icmp", ProtocolICMP, false}} {
+		for _, c := range []struct {
+			name      string
+			rule      NATRule
+			in, out   *Interface
+			orig      testPacket //As sent
+			forwarded testPacket //As translated
+		}{
+			{"snat", snat, natLAN, natWAN,
+				testPacket{src: "192.168.1.10", dst: "198.51.100.7", sport: 40000, dport: 80},
+				testPacket{src: "203.0.113.9", dst: "198.51.100.7", sport: 40000, dport: 80}},
+			{"masquerade", masquerade, natLAN, natWAN,
+				testPacket{src: "192.168.1.10", dst: "203.0.113.50", sport: 40000, dport: 80},
+				testPacket{src: "203.0.113.1", dst: "203.0.113.50", sport: 40000, dport: 80}},
+			{"dnat", dnat, natWAN, natLAN,
+				testPacket{src: "198.51.100.7", dst: "203.0.113.1", sport: 40000, dport: 8080},
+				testPacket{src: "198.51.100.7", dst: "192.168.1.10", sport: 40000, dport: 80}},
+		} {
+			t.Run(protocol.name+"/"+c.name, func(t *testing.T) {
+				orig, forwarded := c.orig, c.forwarded
+				for _, p := range []*testPacket{&orig, &forwarded} {
+					p.protocol, p.noUDPSum = protocol.protocol, protocol.noUDPSum
+					p.payload = []byte("some payload")
+					p.flags, p.seq = 1<<FlagSYN, 1000
+					if p.protocol == ProtocolICMP {
+						p.flags = 0
+						p.dport = p.sport //Echo identifier
+					}
+				}
+				if protocol.protocol == ProtocolICMP && c.rule.Kind == DNAT {
+					forwarded.sport, forwarded.dport = orig.sport, orig.sport //No port to translate
+				}
+
+				nat := NewNAT(nil)
+				nat.AddRule(c.rule)
+				packet := orig.build()
+				natForward(t, nat, packet, c.in, c.out)
+				checkTuple(t, "forwarded", packet, forwarded)
+				checkChecksums(t, "forwarded", packet)
+				if protocol.noUDPSum && binary.BigEndian.Uint16(packet[26:]) != 0 {
+					t.Error("checksum added to a UDP datagram without one")
+				}
+
+				//The answer of the peer is translated back
+				answer := testPacket{protocol: forwarded.protocol, src: forwarded.dst, dst: forwarded.src, sport: forwarded.dport, dport: forwarded.sport,
+					flags: 1<<FlagSYN | 1<<FlagACK, seq: 5000, ack: 1001, noUDPSum: protocol.noUDPSum, payload: []byte("the answer")}
+				back := testPacket{protocol: orig.protocol, src: orig.dst, dst: orig.src, sport: orig.dport, dport: orig.sport}
+				if protocol.protocol == ProtocolICMP {
+					answer.flags = ICMPTypeEchoReply
+				}
+				packet = answer.build()
+				natForward(t, nat, packet, c.out, c.in)
+				checkTuple(t, "answer", packet, back)
+				checkChecksums(t, "answer", packet)
+			})
+		}
+	}
+}
+
+// The second flow with the same source port and destination gets another
+// port, the answers go back to the right client
+func TestNATPortCollision(t *testing.T) {
+	for _, protocol := range []uint8{ProtocolTCP, ProtocolUDP, ProtocolICMP} {
+		t.Run(fmt.Sprint(protocol), func(t *testing.T) {
+			nat := NewNAT(nil)
+			nat.AddRule(NATRule{Kind: Masquerade, OutInterface: "wan"})
+
+			ports := map[uint16]string{}
+			for _, client := range []string{"192.168.1.10", "192.168.1.11"} {
+				p := testPacket{protocol: protocol, src: client, dst: "198.51.100.7", sport: 40000, dport: 53, flags: 1 << FlagSYN, seq: 1000}
+				if protocol == ProtocolICMP {
+					p.flags, p.dport = 0, p.sport
+				}
+				packet := p.build()
+				natForward(t, nat, packet, natLAN, natWAN)
+				checkChecksums(t, client, packet)
+				tuple, _ := parseConntrackTuple(packet)
+				if DecodeIPV4Addr(tuple.src) != "203.0.113.1" {
+					t.Fatal("source not masqueraded:", DecodeIPV4Addr(tuple.src))
+				}
+				if _, ok := ports[tuple.srcPort]; ok {
+					t.Fatal("port", tuple.srcPort, "allocated twice")
+				}
+				ports[tuple.srcPort] = client
+			}
+			if _, ok := ports[40000]; !ok {
+				t.Error("first flow did not keep its port")
+			}
+
+			for port, client := range ports {
+				answer := testPacket{protocol: protocol, src: "198.51.100.7", dst: "203.0.113.1", sport: 53, dport: port, flags: 1<<FlagSYN | 1<<FlagACK, seq: 5000, ack: 1001}
+				if protocol == ProtocolICMP {
+					answer.flags, answer.sport = ICMPTypeEchoReply, port
+				}
+				packet := answer.build()
+				natForward(t, nat, packet, natWAN, natLAN)
+				checkChecksums(t, "answer", packet)
+				back := testPacket{protocol: protocol, src: "198.51.100.7", dst: client, sport: 53, dport: 40000}
+				if protocol == ProtocolICMP {
+					back.sport = 40000
+				}
+				checkTuple(t, "answer", packet, back)
+			}
+		})
+	}
+}
+
+// An ICMP error about a translated packet reaches the client with the
+// quoted header translated back
+func TestNATICMPError(t *testing.T) {
+	nat := NewNAT(nil)
+	nat.AddRule(NATRule{Kind: Masquerade, OutInterface: "wan"})
+	packet := testPacket{protocol: ProtocolTCP, src: "192.168.1.10", dst: "198.51.100.7", sport: 40000, dport: 80, flags: 1 << FlagSYN, seq: 1000}.build()
+	natForward(t, nat, packet, natLAN, natWAN)
+
+	for _, icmpType := range []uint8{ICMPTypeDestUnreachable, ICMPTypeTimeExceeded} {
+		quoted := append([]byte(nil), packet[:28]...)
+		icmpErr := testPacket{protocol: ProtocolICMP, src: "198.51.100.1", dst: "203.0.113.1", flags: icmpType, payload: quoted}.build()
+		binary.BigEndian.PutUint16(icmpErr[24:], 0) //Unused field of the error
+		fillChecksums(icmpErr, true)
+
+		if entry, ok := nat.prerouting(icmpErr, natWAN); !ok || entry != nil {
+			t.Fatal("ICMP error dropped or tracked as a flow")
+		}
+		if dst := net.IP(icmpErr[16:20]).String(); dst != "192.168.1.10" {
+			t.Error("error sent to", dst)
+		}
+		checkChecksums(t, "ICMP error", icmpErr)
+
+		inner := icmpErr[28:]
+		if ipChecksum(inner[:20]) != 0 {
+			t.Error("quoted IP header checksum")
+		}
+		tuple, _ := parseConntrackTuple(inner)
+		if DecodeIPV4Addr(tuple.src) != "192.168.1.10" || tuple.srcPort != 40000 || DecodeIPV4Addr(tuple.dst) != "198.51.100.7" || tuple.dstPort != 80 {
+			t.Errorf("quoted %s:%d -> %s:%d", DecodeIPV4Addr(tuple.src), tuple.srcPort, DecodeIPV4Addr(tuple.dst), tuple.dstPort)
+		}
+	}
+}
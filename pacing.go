@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+)
+
+const pacingBurst = time.Millisecond //Data allowed back to back at the pacing rate
+
+// Token bucket spacing the segments of a connection. The rate is set by the
+// congestion control and can be capped by the application.
+type pacer struct {
+	mss     int
+	ccRate  float64 //Bytes per second, 0 when the congestion control does not pace
+	maxRate float64 //Application cap, 0 for none
+	tokens  float64
+	last    time.Time
+}
+
+func (p *pacer) rate() float64 {
+	rate := p.ccRate
+	if p.maxRate > 0 && (rate == 0 || rate > p.maxRate) {
+		rate = p.maxRate
+	}
+	return rate
+}
+
+func (p *pacer) refill(now time.Time) {
+	rate := p.rate()
+	if rate == 0 || p.last.IsZero() {
+		p.last = now
+		return
+	}
+
+	p.tokens += rate * now.Sub(p.last).Seconds()
+	p.last = now
+
+	burst := rate * pacingBurst.Seconds()
+	if burst < float64(2*p.mss) {
+		burst = float64(2 * p.mss)
+	}
+	if p.tokens > burst {
+		p.tokens = burst
+	}
+}
+
+// Time to wait before the next segment can be sent
+func (p *pacer) delay(now time.Time) time.Duration {
+	rate := p.rate()
+	if rate == 0 {
+		return 0
+	}
+
+	p.refill(now)
+	if p.tokens > 0 {
+		return 0
+	}
+	return time.Duration((1 - p.tokens) / rate * float64(time.Second))
+}
+
+func (p *pacer) consume(length int) {
+	if p.rate() > 0 {
+		p.tokens -= float64(length)
+	}
+}
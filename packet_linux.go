@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Attaches to an existing interface, such as a veth in a network namespace,
+// through an AF_PACKET socket. The interface address is used as the hardware
+// address, the stack IP must not be configured on the interface.
+func PacketLink(name string) LinkOpener {
+	return func(localAddr, remoteAddr *net.IPAddr) (LinkConn, error) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(iface.HardwareAddr) != 6 {
+			return nil, fmt.Errorf("%s is not an Ethernet interface", name)
+		}
+
+		device, err := openPacketSocket(iface, IPV4AddrToInt(localAddr.IP.String()))
+		if err != nil {
+			return nil, err
+		}
+		return NewEthernetIPConn(device, iface.HardwareAddr, localAddr, remoteAddr), nil
+	}
+}
+
+// Raw AF_PACKET socket bound to iface, receiving only the frames for ip
+func openPacketSocket(iface *net.Interface, ip uint32) (*os.File, error) {
+	protocol := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(protocol))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	//Filter before binding, no unwanted frame is queued
+	if err := syscall.AttachLsf(fd, packetFilter(ip)); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt SO_ATTACH_FILTER", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	return newPollableFile(fd, "packet:"+iface.Name), nil
+}
+
+// Classic BPF program accepting the IPv4 packets for ip and the ARP packets
+// whose target is ip
+func packetFilter(ip uint32) []syscall.SockFilter {
+	const (
+		etherTypeOffset = 12
+		ipDstOffset     = ethernetHeaderLen + 16
+		arpTargetOffset = ethernetHeaderLen + 24
+	)
+	return []syscall.SockFilter{
+		*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, etherTypeOffset),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, EtherTypeIPv4, 1, 0),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, EtherTypeARP, 2, 5),
+		*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, ipDstOffset),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, int(ip), 2, 3),
+		*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, arpTargetOffset),
+		*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, int(ip), 0, 1),
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0x40000), //Accept, whole frame
+		*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),       //Drop
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+const (
+	loopbackMTU = 65536
+	defaultMTU  = 1500
+)
+
+// Link attached to the stack with its own addresses and MTU
+type Interface struct {
+	Name  string
+	Addrs []*net.IPNet //Addresses of the stack on the link, with their prefix
+	MTU   int
+	Link  LinkOpener
+
+	Device func() (PacketDevice, error) //Opened by a Router instead of Link, nil if the interface does not forward
+}
+
+// Packets to Dst leave through Interface. Gateway is informative only: the
+// links resolve the destination address itself.
+type Route struct {
+	Dst       *net.IPNet
+	Gateway   net.IP
+	Interface *Interface
+	Src       net.IP //Preferred source address, chosen from the interface if nil
+}
+
+// Routing table of the stack, looked up by longest prefix match
+type RoutingTable struct {
+	mu         sync.Mutex
+	interfaces map[string]*Interface
+	routes     []*Route //Longest prefix first
+}
+
+// Table used by DialTeaCP and ListenTeaCP: the loopback interface and the
+// TUN device tun11, which carries the default route.
+var DefaultRoutes = newDefaultRoutes()
+
+func newDefaultRoutes() *RoutingTable {
+	table := NewRoutingTable()
+	table.AddInterface(&Interface{
+		Name:  "lo",
+		Addrs: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)}},
+		MTU:   loopbackMTU,
+		Link:  OpenLoopback})
+	table.AddInterface(&Interface{
+		Name:   "tun11",
+		Addrs:  []*net.IPNet{{IP: net.IPv4(10, 12, 0, 1).To4(), Mask: net.CIDRMask(24, 32)}},
+		MTU:    defaultMTU,
+		Link:   OpenTun,
+		Device: TunPacketDevice("tun11")})
+	table.AddRoute(&net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, nil, "tun11")
+	return table
+}
+
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{interfaces: make(map[string]*Interface)}
+}
+
+// Attaches the interface and adds a route to the network of each of its
+// addresses
+func (r *RoutingTable) AddInterface(ifc *Interface) error {
+	r.mu.Lock()
+	if _, ok := r.interfaces[ifc.Name]; ok {
+		r.mu.Unlock()
+		return fmt.Errorf("Interface %s already attached", ifc.Name)
+	}
+	r.interfaces[ifc.Name] = ifc
+	r.mu.Unlock()
+
+	for _, addr := range ifc.Addrs {
+		network := &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+		r.addRoute(&Route{Dst: network, Interface: ifc, Src: addr.IP})
+	}
+	return nil
+}
+
+// Detaches the interface and removes its routes
+func (r *RoutingTable) RemoveInterface(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.interfaces, name)
+	routes := r.routes[:0]
+	for _, route := range r.routes {
+		if route.Interface.Name != name {
+			routes = append(routes, route)
+		}
+	}
+	r.routes = routes
+}
+
+func (r *RoutingTable) Interface(name string) *Interface {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.interfaces[name]
+}
+
+// Routes dst through the attached interface name
+func (r *RoutingTable) AddRoute(dst *net.IPNet, gateway net.IP, name string) error {
+	ifc := r.Interface(name)
+	if ifc == nil {
+		return fmt.Errorf("No interface %s", name)
+	}
+	r.addRoute(&Route{Dst: dst, Gateway: gateway, Interface: ifc})
+	return nil
+}
+
+func (r *RoutingTable) addRoute(route *Route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append(r.routes, route)
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		a, _ := r.routes[i].Dst.Mask.Size()
+		b, _ := r.routes[j].Dst.Mask.Size()
+		return a > b
+	})
+}
+
+func (r *RoutingTable) RemoveRoute(dst *net.IPNet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routes := r.routes[:0]
+	for _, route := range r.routes {
+		if !route.Dst.IP.Equal(dst.IP) || !bytes.Equal(route.Dst.Mask, dst.Mask) {
+			routes = append(routes, route)
+		}
+	}
+	r.routes = routes
+}
+
+// Copy of the routes, longest prefix first
+func (r *RoutingTable) Routes() []Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routes := make([]Route, len(r.routes))
+	for i, route := range r.routes {
+		routes[i] = *route
+	}
+	return routes
+}
+
+// Route to dst with its source address set. The addresses of the stack,
+// those of its interfaces and those it listens on, are routed through the
+// loopback interface. Fails with ENETUNREACH if no route matches.
+func (r *RoutingTable) Lookup(dst net.IP) (Route, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ifc := r.localInterface(dst); ifc != nil || loopback.ownAddr(IPV4AddrToInt(dst.String())) {
+		if lo := r.interfaces["lo"]; lo != nil {
+			return Route{Dst: &net.IPNet{IP: dst, Mask: net.CIDRMask(32, 32)}, Interface: lo, Src: dst}, nil
+		}
+	}
+
+	for _, route := range r.routes {
+		if !route.Dst.Contains(dst) {
+			continue
+		}
+		result := *route
+		if result.Src == nil {
+			result.Src = sourceAddr(route.Interface, dst)
+		}
+		if result.Src == nil {
+			return Route{}, fmt.Errorf("No address on interface %s: %w", route.Interface.Name, syscall.EADDRNOTAVAIL)
+		}
+		return result, nil
+	}
+	return Route{}, syscall.ENETUNREACH
+}
+
+// Interface owning the address, nil if none. Must be called with mu held
+func (r *RoutingTable) localInterface(addr net.IP) *Interface {
+	for _, ifc := range r.interfaces {
+		for _, a := range ifc.Addrs {
+			if a.IP.Equal(addr) {
+				return ifc
+			}
+		}
+	}
+	return nil
+}
+
+// Interface owning the address, nil if none
+func (r *RoutingTable) InterfaceOf(addr net.IP) *Interface {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.localInterface(addr)
+}
+
+// Address of the interface on the network of dst, its first one otherwise
+func sourceAddr(ifc *Interface, dst net.IP) net.IP {
+	for _, addr := range ifc.Addrs {
+		if addr.Contains(dst) {
+			return addr.IP
+		}
+	}
+	if len(ifc.Addrs) > 0 {
+		return ifc.Addrs[0].IP
+	}
+	return nil
+}
+
+// Route of a connection from localAddr, nil to let the route choose it. A
+// connection to its own local address stays on the loopback interface.
+func (r *RoutingTable) dialRoute(localAddr, remoteAddr *net.IPAddr) (Route, error) {
+	if localAddr != nil && localAddr.IP.Equal(remoteAddr.IP) {
+		if lo := r.Interface("lo"); lo != nil {
+			return Route{Dst: &net.IPNet{IP: remoteAddr.IP, Mask: net.CIDRMask(32, 32)}, Interface: lo, Src: localAddr.IP}, nil
+		}
+	}
+	route, err := r.Lookup(remoteAddr.IP)
+	if err != nil {
+		return Route{}, err
+	}
+	if localAddr != nil {
+		route.Src = localAddr.IP //Bound by the application
+	}
+	return route, nil
+}
+
+// MSS of a TCP segment without options over a link of this MTU
+func mssForMTU(mtu int) int {
+	if mtu <= 0 {
+		return defaultMSS
+	}
+	if mtu > 65535 {
+		mtu = 65535 //Largest IPv4 packet
+	}
+	return mtu - 40
+}
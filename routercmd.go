@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Forwards between the TUN devices given as name=address/prefix, and dumps
+// the conntrack table each time Enter is pressed
+func routerMain(args []string) {
+	flags := flag.NewFlagSet("router", flag.ExitOnError)
+	masquerade := flags.String("masquerade", "", "Masquerade the flows leaving through this interface")
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		log.Fatalln("Usage : sudo TeaCP router [-masquerade <interface>] <tun>=<address/prefix>...")
+	}
+
+	routes := NewRoutingTable()
+	var names []string
+	for _, arg := range flags.Args() {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalln("Invalid interface", arg)
+		}
+		ip, network, err := net.ParseCIDR(parts[1])
+		if err != nil {
+			log.Fatalln("Invalid address of", parts[0], err)
+		}
+		network.IP = ip.To4()
+		err = routes.AddInterface(&Interface{
+			Name:   parts[0],
+			Addrs:  []*net.IPNet{network},
+			MTU:    defaultMTU,
+			Link:   TunDevice(parts[0], 1),
+			Device: TunPacketDevice(parts[0])})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		names = append(names, parts[0])
+	}
+
+	ct := NewConntrack()
+	router := NewRouter(routes)
+	defer router.Close()
+	if *masquerade != "" {
+		nat := NewNAT(ct)
+		nat.AddRule(NATRule{Kind: Masquerade, OutInterface: *masquerade})
+		router.SetNAT(nat)
+	} else {
+		router.SetConntrack(ct)
+	}
+
+	for _, name := range names {
+		if err := router.Attach(name); err != nil {
+			log.Fatalln("Error while attaching", name, err)
+		}
+	}
+
+	fmt.Println("Press 'Enter' to dump the connections, Ctrl+D to stop")
+	stdin := bufio.NewReader(os.Stdin)
+	for {
+		if _, err := stdin.ReadBytes('\n'); err != nil {
+			return
+		}
+		ct.Dump(os.Stdout)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	initialRTO = time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 60 * time.Second
+)
+
+// Retransmission timer computation (RFC 6298)
+type rttEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+}
+
+func newRTTEstimator() *rttEstimator {
+	return &rttEstimator{rto: initialRTO}
+}
+
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if e.srtt == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	e.rto = e.srtt + 4*e.rttvar
+	if e.rto < minRTO {
+		e.rto = minRTO
+	}
+	if e.rto > maxRTO {
+		e.rto = maxRTO
+	}
+}
+
+func (e *rttEstimator) backoff() {
+	e.rto *= 2
+	if e.rto > maxRTO {
+		e.rto = maxRTO
+	}
+}
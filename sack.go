@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sort"
+)
+
+const (
+	maxSACKBlocks = 4
+	dupThresh     = 3
+)
+
+// Receiver side: SACK blocks built from the out of order queue (RFC 2018)
+// The first block is the one holding the most recently received segment,
+// the following ones are the other blocks in sequence order.
+func sackBlocksFromQueue(queue []*TCPPacket, lastSeq uint32, max int) []sackBlock {
+	var blocks []sackBlock
+	for _, p := range queue {
+		left, right := p.SeqNum, p.SeqNum+uint32(len(p.Data))
+		if len(blocks) > 0 && seqLEQ(left, blocks[len(blocks)-1].Right) {
+			blocks[len(blocks)-1].Right = seqMax(blocks[len(blocks)-1].Right, right)
+			continue
+		}
+		blocks = append(blocks, sackBlock{left, right})
+	}
+
+	for i, block := range blocks {
+		if seqGEQ(lastSeq, block.Left) && seqLT(lastSeq, block.Right) {
+			blocks[0], blocks[i] = blocks[i], blocks[0]
+			break
+		}
+	}
+
+	if len(blocks) > max {
+		blocks = blocks[:max]
+	}
+	return blocks
+}
+
+// Sender side scoreboard (RFC 6675)
+type scoreboard struct {
+	sacked []sackBlock //Merged and sorted SACKed ranges above SND.UNA
+
+	highACK   uint32
+	highData  uint32
+	highRxt   uint32
+	rescueRxt uint32
+
+	inRecovery    bool
+	rtoLoss       bool //Recovery started by a retransmission timeout, every hole is lost
+	recoveryPoint uint32
+	dupAcks       int
+}
+
+func (s *scoreboard) enterRecovery() {
+	s.inRecovery = true
+	s.rtoLoss = false
+	s.recoveryPoint = s.highData
+	s.rescueRxt = s.highACK - 1
+}
+
+// RFC 6675 section 5.1: after a timeout every segment not SACKed is
+// retransmitted, starting again from HighACK.
+func (s *scoreboard) enterRTORecovery() {
+	s.enterRecovery()
+	s.rtoLoss = true
+	s.highRxt = s.highACK
+	s.dupAcks = 0
+}
+
+func (s *scoreboard) reset(seq uint32) {
+	s.sacked = nil
+	s.highACK = seq
+	s.highData = seq
+	s.highRxt = seq
+	s.rescueRxt = seq
+	s.inRecovery = false
+	s.rtoLoss = false
+	s.dupAcks = 0
+}
+
+// Update the scoreboard with a cumulative ack and the SACK blocks of the segment.
+// Returns true if new data was SACKed.
+func (s *scoreboard) update(ack uint32, blocks []sackBlock) bool {
+	newSACK := false
+	for _, block := range blocks {
+		if !seqLT(block.Left, block.Right) || seqLEQ(block.Right, ack) || seqGT(block.Right, s.highData) {
+			continue //Invalid or D-SACK block
+		}
+		if !s.isSACKed(block.Left, block.Right) {
+			newSACK = true
+		}
+		s.sacked = append(s.sacked, block)
+	}
+
+	if seqGT(ack, s.highACK) {
+		s.highACK = ack
+	}
+	if seqLT(s.highRxt, s.highACK) {
+		s.highRxt = s.highACK
+	}
+
+	s.merge()
+	return newSACK
+}
+
+func (s *scoreboard) merge() {
+	sort.Slice(s.sacked, func(i, j int) bool {
+		return seqLT(s.sacked[i].Left, s.sacked[j].Left)
+	})
+
+	var merged []sackBlock
+	for _, block := range s.sacked {
+		if seqLEQ(block.Right, s.highACK) {
+			continue
+		}
+		if seqLT(block.Left, s.highACK) {
+			block.Left = s.highACK
+		}
+		if len(merged) > 0 && seqLEQ(block.Left, merged[len(merged)-1].Right) {
+			merged[len(merged)-1].Right = seqMax(merged[len(merged)-1].Right, block.Right)
+			continue
+		}
+		merged = append(merged, block)
+	}
+	s.sacked = merged
+}
+
+func (s *scoreboard) isSACKed(left, right uint32) bool {
+	for _, block := range s.sacked {
+		if seqLEQ(block.Left, left) && seqGEQ(block.Right, right) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scoreboard) highestSACKed() uint32 {
+	if len(s.sacked) == 0 {
+		return s.highACK
+	}
+	return s.sacked[len(s.sacked)-1].Right
+}
+
+// A segment is lost if DupThresh discontiguous SACKed ranges or
+// more than (DupThresh - 1) * SMSS bytes were SACKed above it.
+func (s *scoreboard) isLost(seq uint32, mss int) bool {
+	if s.inRecovery && s.rtoLoss && seqLT(seq, s.recoveryPoint) {
+		return true
+	}
+
+	blocks, bytes := 0, 0
+	for _, block := range s.sacked {
+		if seqGT(block.Right, seq) {
+			left := seqMax(block.Left, seq+1)
+			blocks++
+			bytes += int(block.Right - left)
+		}
+	}
+	return blocks >= dupThresh || bytes > (dupThresh-1)*mss
+}
+
+// Estimation of the number of bytes in flight
+func (s *scoreboard) pipe(segments []*TCPPacket, mss int) int {
+	pipe := 0
+	for _, p := range segments {
+		end := p.SeqNum + uint32(len(p.Data))
+		if s.isSACKed(p.SeqNum, end) {
+			continue
+		}
+		if !s.isLost(p.SeqNum, mss) {
+			pipe += len(p.Data)
+		}
+		if seqLT(p.SeqNum, s.highRxt) {
+			pipe += len(p.Data)
+		}
+	}
+	return pipe
+}
+
+// Next segment to retransmit during loss recovery. Rule 2 of NextSeg() (new data)
+// is handled by the sender itself when nil is returned.
+func (s *scoreboard) nextSeg(segments []*TCPPacket, mss int) *TCPPacket {
+	//Rule 1: lost segment above HighRxt
+	for _, p := range segments {
+		end := p.SeqNum + uint32(len(p.Data))
+		if seqGEQ(p.SeqNum, s.highRxt) && !s.isSACKed(p.SeqNum, end) && s.isLost(p.SeqNum, mss) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Rule 3 of NextSeg(): a segment not yet SACKed nor lost, below the highest SACKed byte
+func (s *scoreboard) nextUnSACKed(segments []*TCPPacket) *TCPPacket {
+	highest := s.highestSACKed()
+	for _, p := range segments {
+		end := p.SeqNum + uint32(len(p.Data))
+		if seqGEQ(p.SeqNum, s.highRxt) && seqLT(p.SeqNum, highest) && !s.isSACKed(p.SeqNum, end) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Rule 4 of NextSeg(): rescue retransmission of the last segment, once per recovery
+func (s *scoreboard) rescueSeg(segments []*TCPPacket) *TCPPacket {
+	if len(segments) == 0 || !seqGT(s.highACK, s.rescueRxt) {
+		return nil
+	}
+	last := segments[len(segments)-1]
+	if s.isSACKed(last.SeqNum, last.SeqNum+uint32(len(last.Data))) {
+		return nil
+	}
+	s.rescueRxt = s.recoveryPoint
+	return last
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testMSS = 100
+
+// Ten segments of testMSS bytes from 1000
+func testSegments() []*TCPPacket {
+	var segments []*TCPPacket
+	for seq := uint32(1000); seq < 2000; seq += testMSS {
+		segments = append(segments, &TCPPacket{SeqNum: seq, Data: make([]byte, testMSS)})
+	}
+	return segments
+}
+
+func testScoreboard(sacked ...sackBlock) *scoreboard {
+	s := &scoreboard{}
+	s.reset(1000)
+	s.highData = 2000
+	s.update(1000, sacked)
+	return s
+}
+
+func TestScoreboardUpdate(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		before  []sackBlock
+		ack     uint32
+		blocks  []sackBlock
+		newSACK bool
+		after   []sackBlock
+	}{
+		{"overlapping", nil, 1000, []sackBlock{{1200, 1400}, {1300, 1500}}, true, []sackBlock{{1200, 1500}}},
+		{"adjacent", nil, 1000, []sackBlock{{1300, 1400}, {1200, 1300}}, true, []sackBlock{{1200, 1400}}},
+		{"disjoint", nil, 1000, []sackBlock{{1600, 1700}, {1200, 1300}}, true, []sackBlock{{1200, 1300}, {1600, 1700}}},
+		{"D-SACK below the ACK", nil, 1000, []sackBlock{{900, 1000}}, false, nil},
+		{"D-SACK of SACKed data", []sackBlock{{1200, 1500}}, 1000, []sackBlock{{1300, 1400}, {1200, 1500}}, false, []sackBlock{{1200, 1500}}},
+		{"extends a block", []sackBlock{{1200, 1500}}, 1000, []sackBlock{{1200, 1600}}, true, []sackBlock{{1200, 1600}}},
+		{"beyond HighData", nil, 1000, []sackBlock{{1900, 2100}}, false, nil},
+		{"empty", nil, 1000, []sackBlock{{1300, 1300}}, false, nil},
+		{"cumulative ACK inside a block", []sackBlock{{1200, 1500}}, 1300, nil, false, []sackBlock{{1300, 1500}}},
+		{"cumulative ACK above the blocks", []sackBlock{{1200, 1300}, {1400, 1500}}, 1600, nil, false, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := testScoreboard(c.before...)
+			if newSACK := s.update(c.ack, c.blocks); newSACK != c.newSACK {
+				t.Error("new SACK", newSACK)
+			}
+			if !reflect.DeepEqual(s.sacked, c.after) {
+				t.Errorf("scoreboard %v, want %v", s.sacked, c.after)
+			}
+			if s.highACK != c.ack || seqLT(s.highRxt, s.highACK) {
+				t.Error("HighACK", s.highACK, "HighRxt", s.highRxt)
+			}
+		})
+	}
+}
+
+func TestScoreboardIsLost(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		sacked []sackBlock
+		seq    uint32
+		lost   bool
+	}{
+		{"DupThresh blocks above", []sackBlock{{1100, 1200}, {1300, 1400}, {1500, 1600}}, 1000, true},
+		{"two blocks above", []sackBlock{{1100, 1200}, {1300, 1400}, {1500, 1600}}, 1200, false},
+		{"more than (DupThresh-1)*SMSS bytes above", []sackBlock{{1100, 1400}}, 1000, true},
+		{"(DupThresh-1)*SMSS bytes above", []sackBlock{{1100, 1300}}, 1000, false},
+		{"SACKed below only", []sackBlock{{1000, 1400}}, 1500, false},
+		{"nothing SACKed", nil, 1000, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if lost := testScoreboard(c.sacked...).isLost(c.seq, testMSS); lost != c.lost {
+				t.Error("lost", lost)
+			}
+		})
+	}
+
+	//After a timeout every hole below the recovery point is lost
+	s := testScoreboard()
+	s.enterRTORecovery()
+	if !s.isLost(1000, testMSS) || !s.isLost(1900, testMSS) {
+		t.Error("holes not lost after RTO")
+	}
+}
+
+func TestScoreboardPipe(t *testing.T) {
+	segments := testSegments()
+	s := testScoreboard(sackBlock{1500, 1800})
+
+	//1000-1499 lost: 300 bytes SACKed above them. 1800-1999 in flight
+	if pipe := s.pipe(segments, testMSS); pipe != 200 {
+		t.Fatal("pipe", pipe, "want 200")
+	}
+	//A retransmission is in flight again
+	s.highRxt = 1100
+	if pipe := s.pipe(segments, testMSS); pipe != 300 {
+		t.Fatal("pipe", pipe, "after a retransmission, want 300")
+	}
+	//Retransmitted and not lost counts twice (RFC 6675 SetPipe)
+	s = testScoreboard()
+	s.highRxt = 1100
+	if pipe := s.pipe(segments, testMSS); pipe != 1100 {
+		t.Fatal("pipe", pipe, "want 1100")
+	}
+}
+
+func TestScoreboardNextSeg(t *testing.T) {
+	segments := testSegments()
+
+	//Rule 1: first lost segment above HighRxt
+	s := testScoreboard(sackBlock{1500, 1800})
+	s.enterRecovery()
+	if p := s.nextSeg(segments, testMSS); p == nil || p.SeqNum != 1000 {
+		t.Fatal("rule 1:", p)
+	}
+	s.highRxt = 1100
+	if p := s.nextSeg(segments, testMSS); p == nil || p.SeqNum != 1100 {
+		t.Fatal("rule 1 after a retransmission:", p)
+	}
+	s.highRxt = 1500
+	if p := s.nextSeg(segments, testMSS); p != nil {
+		t.Fatal("rule 1 once the holes are retransmitted:", p.SeqNum)
+	}
+
+	//Rule 2 is new data, left to the sender when nothing is lost
+	s = testScoreboard(sackBlock{1500, 1600})
+	s.enterRecovery()
+	if p := s.nextSeg(segments, testMSS); p != nil {
+		t.Fatal("rule 1 without loss:", p.SeqNum)
+	}
+
+	//Rule 3: not SACKed, below the highest SACKed byte
+	if p := s.nextUnSACKed(segments); p == nil || p.SeqNum != 1000 {
+		t.Fatal("rule 3:", p)
+	}
+	s.highRxt = 1500
+	if p := s.nextUnSACKed(segments); p != nil {
+		t.Fatal("rule 3 above the highest SACKed byte:", p.SeqNum)
+	}
+
+	//Rule 4: the last segment, once per recovery
+	if p := s.rescueSeg(segments); p == nil || p.SeqNum != 1900 {
+		t.Fatal("rule 4:", p)
+	}
+	if p := s.rescueSeg(segments); p != nil {
+		t.Fatal("second rescue retransmission")
+	}
+	s = testScoreboard(sackBlock{1900, 2000})
+	s.enterRecovery()
+	if p := s.rescueSeg(segments); p != nil {
+		t.Fatal("rescue of a SACKed segment")
+	}
+}
+
+func TestSACKBlocksFromQueue(t *testing.T) {
+	var queue []*TCPPacket
+	for _, r := range [][2]uint32{{1200, 1300}, {1250, 1400}, {1400, 1450}, {1600, 1700}, {1900, 2000}, {2100, 2200}, {2300, 2400}} {
+		queue = append(queue, &TCPPacket{SeqNum: r[0], Data: make([]byte, r[1]-r[0])})
+	}
+
+	for _, c := range []struct {
+		name    string
+		lastSeq uint32
+		max     int
+		blocks  []sackBlock
+	}{
+		{"latest first", 1900, 4, []sackBlock{{1900, 2000}, {1600, 1700}, {1200, 1450}, {2100, 2200}}},
+		{"latest in a merged block", 1420, 3, []sackBlock{{1200, 1450}, {1600, 1700}, {1900, 2000}}},
+		{"all", 2300, 10, []sackBlock{{2300, 2400}, {1600, 1700}, {1900, 2000}, {2100, 2200}, {1200, 1450}}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if blocks := sackBlocksFromQueue(queue, c.lastSeq, c.max); !reflect.DeepEqual(blocks, c.blocks) {
+				t.Errorf("blocks %v, want %v", blocks, c.blocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Simulated bottleneck link, used to compare the congestion control
+// algorithms on a lossy path without any TUN device.
+type SimLink struct {
+	Bandwidth  float64       //Bytes per second
+	RTT        time.Duration //Propagation round trip time
+	BufferSize int           //Bottleneck queue size in bytes
+	LossRate   float64       //Random loss probability, independent of the queue
+}
+
+type SimResult struct {
+	Sent      int //Segments, retransmissions included
+	Delivered int
+	Lost      int
+	Goodput   float64 //Bytes per second
+	AvgRTT    time.Duration
+}
+
+type simAck struct {
+	at     time.Time
+	seq    int
+	sentAt time.Time
+}
+
+// Runs a bulk transfer through the link for the given (simulated) duration
+func (l *SimLink) Run(cc CongestionControl, mss int, duration time.Duration, seed int64) SimResult {
+	var result SimResult
+	random := rand.New(rand.NewSource(seed))
+
+	now := time.Unix(0, 0)
+	end := now.Add(duration)
+	if setter, ok := cc.(clockSetter); ok {
+		setter.setClock(func() time.Time { return now })
+	}
+
+	nextSeq := 0
+	outstanding := []int{} //Sent segments not yet acked or lost, in order
+	sentAt := map[int]time.Time{}
+	var acks []simAck
+	var queueFreeAt, nextSendTime time.Time
+	recoveryPoint := -1
+	var rttSum time.Duration
+	serialization := time.Duration(float64(mss) / l.Bandwidth * float64(time.Second))
+
+	for now.Before(end) {
+		//Send as much as the window and the pacing rate allow
+		for len(outstanding)*mss+mss <= cc.CongestionWindow() && !now.Before(nextSendTime) {
+			seq := nextSeq
+			nextSeq++
+			result.Sent++
+			outstanding = append(outstanding, seq)
+			sentAt[seq] = now
+
+			if pacer, ok := cc.(PacedCongestionControl); ok && pacer.PacingRate() > 0 {
+				nextSendTime = now.Add(time.Duration(float64(mss) / pacer.PacingRate() * float64(time.Second)))
+			}
+
+			if queueFreeAt.Before(now) {
+				queueFreeAt = now
+			}
+			queued := int(queueFreeAt.Sub(now).Seconds() * l.Bandwidth)
+			if queued+mss > l.BufferSize || random.Float64() < l.LossRate {
+				continue //Dropped, detected later by the sender
+			}
+			queueFreeAt = queueFreeAt.Add(serialization)
+			acks = append(acks, simAck{queueFreeAt.Add(l.RTT), seq, now})
+		}
+
+		//Next event: an ACK, the pacing timer or a retransmission timeout
+		next := end
+		if len(acks) > 0 {
+			next = acks[0].at
+		} else if len(outstanding) > 0 {
+			rto := 2 * l.RTT
+			if rto < minRTO {
+				rto = minRTO
+			}
+			next = sentAt[outstanding[len(outstanding)-1]].Add(rto)
+		}
+		if len(outstanding)*mss+mss <= cc.CongestionWindow() && nextSendTime.After(now) && nextSendTime.Before(next) {
+			next = nextSendTime
+		}
+		if !next.After(now) {
+			next = now.Add(time.Microsecond)
+		}
+		now = next
+		if !now.Before(end) {
+			break
+		}
+
+		if len(acks) == 0 || acks[0].at.After(now) {
+			if len(acks) == 0 && len(outstanding) > 0 && !now.Before(sentAt[outstanding[len(outstanding)-1]].Add(minRTO)) {
+				//Everything in flight was lost
+				cc.OnRTO(len(outstanding) * mss)
+				result.Lost += len(outstanding)
+				for _, seq := range outstanding {
+					delete(sentAt, seq)
+				}
+				outstanding = outstanding[:0]
+			}
+			continue
+		}
+
+		ack := acks[0]
+		acks = acks[1:]
+		inFlight := len(outstanding) * mss
+
+		//Segments sent 3 positions before the acked one are lost
+		lost := false
+		remaining := outstanding[:0]
+		for _, seq := range outstanding {
+			if seq == ack.seq {
+				delete(sentAt, seq)
+				continue
+			}
+			if seq+dupThresh <= ack.seq {
+				lost = true
+				result.Lost++
+				delete(sentAt, seq)
+				continue
+			}
+			remaining = append(remaining, seq)
+		}
+		outstanding = remaining
+
+		result.Delivered++
+		rtt := now.Sub(ack.sentAt)
+		rttSum += rtt
+		if lost && ack.seq > recoveryPoint {
+			recoveryPoint = nextSeq
+			cc.OnLoss(inFlight)
+		}
+		cc.OnAck(mss, rtt, inFlight)
+	}
+
+	result.Goodput = float64(result.Delivered*mss) / duration.Seconds()
+	if result.Delivered > 0 {
+		result.AvgRTT = rttSum / time.Duration(result.Delivered)
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 10 Mbit/s bottleneck, 40ms RTT, one BDP of buffer and 1% random loss
+func lossyLink() *SimLink {
+	return &SimLink{
+		Bandwidth:  1250000,
+		RTT:        40 * time.Millisecond,
+		BufferSize: 50000,
+		LossRate:   0.01}
+}
+
+func TestBBROnLossyLink(t *testing.T) {
+	const mss = 1460
+	link := lossyLink()
+
+	bbr := NewBBR(mss)
+	bbrResult := link.Run(bbr, mss, 30*time.Second, 1)
+	cubicResult := link.Run(NewCubic(mss), mss, 30*time.Second, 1)
+	t.Logf("BBR %+v", bbrResult)
+	t.Logf("CUBIC %+v", cubicResult)
+
+	if bbrResult.Goodput < 0.7*link.Bandwidth {
+		t.Errorf("BBR goodput %.0f B/s, want at least 70%% of %.0f B/s", bbrResult.Goodput, link.Bandwidth)
+	}
+	if bbrResult.Goodput <= cubicResult.Goodput {
+		t.Errorf("BBR goodput %.0f B/s not above CUBIC %.0f B/s with random loss", bbrResult.Goodput, cubicResult.Goodput)
+	}
+
+	//The model converges on the path: bottleneck bandwidth and propagation RTT
+	if bbr.btlBw < 0.8*link.Bandwidth || bbr.btlBw > 1.25*link.Bandwidth {
+		t.Errorf("BBR bandwidth estimate %.0f B/s, link is %.0f B/s", bbr.btlBw, link.Bandwidth)
+	}
+	if bbr.minRTT < link.RTT || bbr.minRTT > link.RTT+10*time.Millisecond {
+		t.Errorf("BBR min RTT estimate %v, link is %v", bbr.minRTT, link.RTT)
+	}
+}
+
+func TestSimLinkLossless(t *testing.T) {
+	const mss = 1460
+	link := lossyLink()
+	link.LossRate = 0
+
+	for name, cc := range map[string]CongestionControl{"bbr": NewBBR(mss), "cubic": NewCubic(mss)} {
+		result := link.Run(cc, mss, 30*time.Second, 1)
+		if result.Goodput < 0.8*link.Bandwidth {
+			t.Errorf("%s goodput %.0f B/s on a lossless link of %.0f B/s", name, result.Goodput, link.Bandwidth)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+type tcpState int
+
+const (
+	StateClosed tcpState = iota
+	StateListen
+	StateSynSent
+	StateSynReceived
+	StateEstablished
+)
+
+func (s tcpState) String() string {
+	switch s {
+	case StateClosed:
+		return "CLOSED"
+	case StateListen:
+		return "LISTEN"
+	case StateSynSent:
+		return "SYN-SENT"
+	case StateSynReceived:
+		return "SYN-RECEIVED"
+	case StateEstablished:
+		return "ESTABLISHED"
+	}
+	return "UNKNOWN"
+}
+
+// States where the sequence numbers of both sides are known
+func (s tcpState) synchronized() bool {
+	return s >= StateSynReceived
+}
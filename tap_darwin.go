@@ -0,0 +1,11 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// TAP devices of the tuntap kernel extension, /dev/tap0 to /dev/tap15
+func openTapDevice(name string) (io.ReadWriteCloser, error) {
+	return os.OpenFile("/dev/"+name, os.O_RDWR, os.ModeCharDevice)
+}
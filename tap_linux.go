@@ -0,0 +1,15 @@
+package main
+
+import (
+	"io"
+	"syscall"
+)
+
+// Creates or attaches to the TAP interface name through /dev/net/tun
+func openTapDevice(name string) (io.ReadWriteCloser, error) {
+	fd, err := openTunFd(name, syscall.IFF_TAP|syscall.IFF_NO_PI)
+	if err != nil {
+		return nil, err
+	}
+	return newPollableFile(fd, "/dev/net/tun"), nil
+}
@@ -38,14 +38,33 @@ type TCPPacket struct {
 	Urgent     uint16
 	Options    []TCPOption
 	Data       []byte
+
+	handshakeACK bool //ACK completing the handshake, its ACE field is not a CE counter
 }
 
+const (
+	OptionEnd           = 0
+	OptionNOP           = 1
+	OptionMSS           = 2
+	OptionWindowScale   = 3
+	OptionSACKPermitted = 4
+	OptionSACK          = 5
+	OptionTimestamps    = 8
+	OptionUserTimeout   = 28
+)
+
 type TCPOption struct {
 	Kind   uint8
 	Length uint8
 	Data   []byte
 }
 
+// Left edge / right edge (exclusive) of a SACK block
+type sackBlock struct {
+	Left  uint32
+	Right uint32
+}
+
 func NewTCPPacket(data []byte) *TCPPacket {
 	var packet TCPPacket
 	reader := bytes.NewReader(data)
@@ -65,19 +84,83 @@ func NewTCPPacket(data []byte) *TCPPacket {
 	binary.Read(reader, binary.BigEndian, &packet.Checksum)
 	binary.Read(reader, binary.BigEndian, &packet.Urgent)
 
-	if packet.DataOffset > 5 {
+	headerLen := int(packet.DataOffset) * 4
 
+	if packet.DataOffset > 5 && len(data) >= headerLen {
+		packet.Options = parseTCPOptions(data[20:headerLen])
 	}
 
-	headerLen := packet.DataOffset * 4
-
-	if len(data) > int(headerLen) {
+	if len(data) > headerLen {
 		packet.Data = data[headerLen:]
 	}
 
 	return &packet
 }
 
+func parseTCPOptions(data []byte) []TCPOption {
+	var options []TCPOption
+	for i := 0; i < len(data); {
+		kind := data[i]
+		if kind == OptionEnd {
+			break
+		}
+		if kind == OptionNOP {
+			i++
+			continue
+		}
+		if i+1 >= len(data) {
+			break
+		}
+		length := int(data[i+1])
+		if length < 2 || i+length > len(data) {
+			break //Malformed option
+		}
+		options = append(options, TCPOption{Kind: kind, Length: uint8(length), Data: data[i+2 : i+length]})
+		i += length
+	}
+	return options
+}
+
+func (packet *TCPPacket) Option(kind uint8) *TCPOption {
+	for i := range packet.Options {
+		if packet.Options[i].Kind == kind {
+			return &packet.Options[i]
+		}
+	}
+	return nil
+}
+
+func (packet *TCPPacket) AddOption(kind uint8, data []byte) {
+	packet.Options = append(packet.Options, TCPOption{Kind: kind, Length: uint8(2 + len(data)), Data: data})
+}
+
+func (packet *TCPPacket) SACKBlocks() []sackBlock {
+	option := packet.Option(OptionSACK)
+	if option == nil {
+		return nil
+	}
+
+	var blocks []sackBlock
+	for i := 0; i+8 <= len(option.Data); i += 8 {
+		blocks = append(blocks, sackBlock{
+			Left:  binary.BigEndian.Uint32(option.Data[i:]),
+			Right: binary.BigEndian.Uint32(option.Data[i+4:])})
+	}
+	return blocks
+}
+
+func (packet *TCPPacket) AddSACKBlocks(blocks []sackBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+	data := make([]byte, 8*len(blocks))
+	for i, block := range blocks {
+		binary.BigEndian.PutUint32(data[i*8:], block.Left)
+		binary.BigEndian.PutUint32(data[i*8+4:], block.Right)
+	}
+	packet.AddOption(OptionSACK, data)
+}
+
 func (packet *TCPPacket) SetFlag(flag uint8) {
 	packet.Flags |= (1 << flag)
 }
@@ -93,6 +176,17 @@ func (packet *TCPPacket) HasFlag(flag uint8) bool {
 func (packet *TCPPacket) Marshall(srcIP, dstIP string) []byte {
 	packet.Checksum = 0
 
+	optionsLen := 0
+	for _, option := range packet.Options {
+		if option.Length > 1 {
+			optionsLen += int(option.Length)
+		} else {
+			optionsLen++
+		}
+	}
+	padding := (4 - optionsLen%4) % 4
+	packet.DataOffset = uint8(5 + (optionsLen+padding)/4)
+
 	buffer := new(bytes.Buffer)
 	binary.Write(buffer, binary.BigEndian, packet.SrcPort)
 	binary.Write(buffer, binary.BigEndian, packet.DestPort)
@@ -110,6 +204,9 @@ func (packet *TCPPacket) Marshall(srcIP, dstIP string) []byte {
 			binary.Write(buffer, binary.BigEndian, option.Data)
 		}
 	}
+	for i := 0; i < padding; i++ {
+		binary.Write(buffer, binary.BigEndian, uint8(OptionEnd))
+	}
 
 	if packet.Data != nil {
 		binary.Write(buffer, binary.BigEndian, packet.Data)
@@ -198,6 +295,30 @@ func checksum(tcpData []byte, srcIP, dstIP string) uint16 {
 	return uint16(^sum)
 }
 
+// Sequence number comparisons (modulo 2^32)
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func seqGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func seqGEQ(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
+
+func seqMax(a, b uint32) uint32 {
+	if seqGT(a, b) {
+		return a
+	}
+	return b
+}
+
 func ipToBytes(ip string) [4]byte {
 	parts := strings.Split(ip, ".")
 	b0, _ := strconv.Atoi(parts[0])
@@ -215,8 +336,12 @@ func Flag(set uint8, flag uint8, value bool) uint8 {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "router" {
+		routerMain(os.Args[2:])
+		return
+	}
 	if len(os.Args) < 2 {
-		log.Fatalln("Usage : sudo TeaCP <dest address> <port>")
+		log.Fatalln("Usage : sudo TeaCP <dest address> <port>\n        sudo TeaCP router [-masquerade <interface>] <tun>=<address/prefix>...")
 	}
 	destIP := os.Args[1]
 	port, _ := strconv.Atoi(os.Args[2])
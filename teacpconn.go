@@ -3,17 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"errors"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type TeaCPConn struct {
-	ipConn          *TunIPConn
+	state           tcpState
+	err             error //Set when the connection is aborted, protected by sendCond.L
+	ipConn          IPConn
+	link            LinkOpener //Opens ipConn when dialing, chosen by the route if nil
+	mtu             int        //MTU of the link, 0 if unknown
 	localIPAddr     *net.IPAddr
 	remoteIPAddr    *net.IPAddr
 	destPort        uint16
@@ -23,46 +29,162 @@ type TeaCPConn struct {
 
 	lastSentAck     uint32
 	lastReceivedAck uint32
+	ackNow          bool
+	delayedAck      time.Duration //0 disables delayed ACKs
+	delayedAckTimer *time.Timer
 
-	sendBuffer       [][]byte
+	keepAlive       KeepAliveConfig
+	keepAliveTimer  *time.Timer
+	keepAliveProbes int //Unanswered probes
+	keepAliveProbe  bool
+	lastReceived    time.Time
+	lastProbe       time.Time
+
+	userTimeout          time.Duration //0 when disabled
+	userTimeoutLocal     bool          //Set by the application, the peer's value is ignored
+	peerUserTimeout      time.Duration //Last value advertised by the peer, limited
+	advertiseUserTimeout bool
+	userTimeoutTimer     *time.Timer
+	unackedSince         time.Time //Since when the oldest unacknowledged data waits
+
+	mss            int
+	peerMSS        int //MSS option of the peer, 0 if none
+	remoteWindow   int
+	sackPermitted  bool
+	scoreboard     scoreboard
+	fastRetransmit bool
+	cc             CongestionControl
+	rtt            *rttEstimator
+	rtoTimer       *time.Timer
+	synRTO         time.Duration //First handshake retransmission timeout, initialRTO if 0
+	rttTiming      bool          //A segment is being timed for RTT measurement
+	rttSeq         uint32
+	rttStart       time.Time
+	ecnMode        ECNMode //Requested, then negotiated mode
+	ecnEcho        bool    //CE received, ECE set until the peer sends CWR
+	ecnCWR         bool    //Window reduced, CWR set on the next new data
+	ecnReacted     bool
+	ecnRecover     uint32 //No new reduction before this sequence is acked
+	rcvCEP         uint32 //AccECN: CE marked packets received
+	sndCEP         uint32 //AccECN: CE marks reported by the peer
+	tsEnabled      bool   //Timestamps option negotiated
+	tsStart        time.Time
+	tsOffset       uint32
+	tsRecent       uint32 //Last TSval of the peer to echo
+	tsRecentAge    time.Time
+	pacer          pacer
+	pacingTimer    *time.Timer
+
+	sendBuffer       []byte
+	noDelay          bool //Nagle's algorithm disabled
+	corked           bool
+	sndUrgentPending bool
+	sndUrgentPointer uint32
 	sendCond         *sync.Cond
-	ackWaitingBuffer []*TCPPacket
+	batching         bool         //Segments are queued in batch, written by the sender
+	batch            []Segment    //Written at once when the link is a BatchConn
+	ackWaitingBuffer []*TCPPacket //Sent but not yet acknowledged packets, in sequence order
 
 	rcvBuffer     *bytes.Buffer
-	oooRcvPackets []*TCPPacket //Out of Order packets
+	rcvErr        error //Copy of err, protected by rcvBufferCon.L
+	oobInline     bool
+	oobByte       byte
+	oobValid      bool
+	rcvMark       int          //Bytes to read before the urgent mark, -1 if none
+	oooRcvPackets []*TCPPacket //Out of Order packets, in sequence order
+	lastOOOSeqNum uint32
 	rcvBufferCon  *sync.Cond
+
+	rcvUrgentPending bool
+	rcvUrgentPointer uint32
 }
 
+const (
+	defaultMSS        = 1460
+	defaultDelayedAck = 200 * time.Millisecond
+	maxDelayedAck     = 500 * time.Millisecond //RFC 1122
+	maxSYNRetries     = 5
+	receiveWindow     = 4096 * 8
+	maxBatchSegments  = 64
+	readBatchSegments = 8
+)
+
 func DialTeaCP(localAddr, remoteAddr *net.IPAddr, destPort int) (*TeaCPConn, error) {
+	return DialContext(context.Background(), localAddr, remoteAddr, destPort)
+}
+
+func DialTimeout(localAddr, remoteAddr *net.IPAddr, destPort int, timeout time.Duration) (*TeaCPConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return DialContext(ctx, localAddr, remoteAddr, destPort)
+}
+
+// Errors are *net.OpError wrapping syscall.ECONNREFUSED, syscall.ETIMEDOUT,
+// an *ICMPUnreachableError or the error of the context.
+func DialContext(ctx context.Context, localAddr, remoteAddr *net.IPAddr, destPort int) (*TeaCPConn, error) {
 	conn := &TeaCPConn{
 		localIPAddr:  localAddr,
 		remoteIPAddr: remoteAddr,
 		destPort:     uint16(destPort)}
+	return dial(ctx, conn)
+}
 
-	err := conn.open()
+func dial(ctx context.Context, conn *TeaCPConn) (*TeaCPConn, error) {
+	err := conn.open(ctx)
 	if err != nil {
-		return nil, err
+		return nil, conn.opError("dial", err)
 	}
 	return conn, nil
 }
 
-func (t *TeaCPConn) open() error {
-	rand.Seed(time.Now().Unix())
-	t.sourcePort = uint16(rand.Int())
-
-	t.ipConn = NewTunIPConn(t.localIPAddr, t.remoteIPAddr)
+func openTunIPConn(name string, localAddr, remoteAddr *net.IPAddr, queues int) (*TunIPConn, error) {
+	ipConn := NewTunIPConn(localAddr, remoteAddr)
+	ipConn.name = name
 
-	err := t.ipConn.Open()
+	err := ipConn.OpenQueues(queues)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	waitForSetup("Try: sudo ifconfig " + name + " 10.12.0.2 10.12.0.1")
+	return ipConn, nil
+}
+
+func waitForSetup(hint string) {
 	fmt.Println("Interface opened. Pause while setup.")
-	fmt.Println("Try: sudo ifconfig tun11 10.12.0.2 10.12.0.1")
+	fmt.Println(hint)
 	fmt.Print("Press 'Enter' to continue...")
 	bufio.NewReader(os.Stdin).ReadBytes('\n')
 	fmt.Println("GO !")
+}
+
+func (t *TeaCPConn) open(ctx context.Context) error {
+	rand.Seed(time.Now().Unix())
+	if t.sourcePort == 0 {
+		t.sourcePort = uint16(rand.Int())
+	}
+
+	route, err := DefaultRoutes.dialRoute(t.localIPAddr, t.remoteIPAddr)
+	if err != nil && (t.link == nil || t.localIPAddr == nil) {
+		return err
+	}
+	openLink := t.link
+	if openLink == nil {
+		openLink = route.Interface.Link
+		t.mtu = route.Interface.MTU
+	}
+	if t.localIPAddr == nil {
+		t.localIPAddr = &net.IPAddr{IP: route.Src}
+	}
+	ipConn, err := openLink(t.localIPAddr, t.remoteIPAddr)
+	if err != nil {
+		return err
+	}
+	bindPorts(ipConn, t.sourcePort, t.destPort)
+	t.ipConn = ipConn
 
+	t.state = StateSynSent
+	t.initTimestamps()
 	packet := &TCPPacket{}
 	packet.SrcPort = t.sourcePort
 	packet.DestPort = t.destPort
@@ -71,34 +193,52 @@ func (t *TeaCPConn) open() error {
 	packet.SeqNum = uint32(rand.Int())
 	packet.AckNum = 0
 	packet.WindowSize = uint16(4096 * 8)
-
-	b := packet.Marshall(t.localIPAddr.String(), t.remoteIPAddr.IP.String())
-	fmt.Println("TCP Output len:", len(b))
-
-	length, err := t.ipConn.Write(b)
-	if err != nil {
-		fmt.Println("Error while sending SYN TCP Packet:", err)
-		return err
-	}
-	fmt.Printf("%d bytes sent (TCP Seq:%d, Ack:%d)\n", length, packet.SeqNum, packet.AckNum)
+	t.addMSS(packet)
+	packet.AddOption(OptionSACKPermitted, nil)
+	packet.AddOption(OptionTimestamps, encodeTimestamps(t.tsVal(), 0))
+	t.ecnSYN(packet)
 
 	//Receive SYN+ACK
-	buffer := make([]byte, 4096*16)
-	length, err = t.ipConn.Read(buffer)
+	responseTcp, err := t.handshake(ctx, packet, func(responseTcp *TCPPacket) (bool, error) {
+		acceptable := responseTcp.HasFlag(FlagACK) && responseTcp.AckNum == packet.SeqNum+1
+		if responseTcp.HasFlag(FlagRST) {
+			if acceptable || (t.state == StateSynReceived && responseTcp.SeqNum == packet.AckNum) {
+				return false, syscall.ECONNREFUSED
+			}
+			return false, nil
+		}
+		if responseTcp.HasFlag(FlagACK) && !acceptable {
+			t.sendReset(responseTcp)
+			return false, nil
+		}
+		if responseTcp.HasFlag(FlagSYN) && !responseTcp.HasFlag(FlagACK) {
+			return false, t.simultaneousOpen(packet, responseTcp)
+		}
+		if t.state == StateSynReceived {
+			return acceptable, nil //SYN+ACK or ACK of our SYN+ACK
+		}
+		return responseTcp.HasFlag(FlagSYN) && acceptable, nil
+	})
 	if err != nil {
-		fmt.Println("Error while reading tun interface", err)
+		t.state = StateClosed
+		t.ipConn.Close()
 		return err
 	}
-	fmt.Println(length, "bytes read")
-	//dump(buffer[:length])
 
-	responseTcp := NewTCPPacket(buffer[:length])
-	fmt.Println("")
-	fmt.Println("TCP Packet")
-	fmt.Println(responseTcp.String())
-
-	if !(responseTcp.HasFlag(FlagSYN) && responseTcp.HasFlag(FlagACK)) {
-		return errors.New("Connection refused")
+	if t.state == StateSynSent {
+		t.sackPermitted = responseTcp.Option(OptionSACKPermitted) != nil
+		t.negotiateMSS(responseTcp)
+		t.negotiateTimestamps(responseTcp)
+		t.ecnSYNACKReceived(responseTcp)
+	}
+	if !responseTcp.HasFlag(FlagSYN) {
+		//Simultaneous open completed by the ACK of our SYN+ACK
+		t.establish(responseTcp.AckNum, packet.AckNum, responseTcp.WindowSize)
+		if len(responseTcp.Data) > 0 {
+			responseTcp.handshakeACK = true
+			t.handlePacket(responseTcp, ECNNotECT)
+		}
+		return nil
 	}
 
 	//SEND ACK
@@ -110,60 +250,481 @@ func (t *TeaCPConn) open() error {
 	packet.SeqNum = responseTcp.AckNum
 	packet.AckNum = responseTcp.SeqNum + 1
 	packet.WindowSize = uint16(4096 * 8)
+	t.addTimestamps(packet)
+	if t.ecnMode == ECNAccurate {
+		packet.setACE(0x2) //SYN+ACK received Not-ECT
+	}
 
-	b = packet.Marshall(t.localIPAddr.String(), t.remoteIPAddr.IP.String())
+	b := packet.Marshall(t.localIPAddr.String(), t.remoteIPAddr.IP.String())
 	fmt.Println("TCP Output len:", len(b))
 
-	length, err = t.ipConn.Write(b)
+	length, err := t.ipConn.Write(b)
 	if err != nil {
 		fmt.Println("Error while sending SYN TCP Packet:", err)
+		t.state = StateClosed
+		t.ipConn.Close()
 		return err
 	}
 	fmt.Printf("%d bytes sent (TCP Seq:%d, Ack:%d)\n", length, packet.SeqNum, packet.AckNum)
 
-	t.remoteSeqNumber = packet.AckNum
-	t.localSeqNumber = packet.SeqNum
-	t.lastSentAck = packet.AckNum
+	t.establish(packet.SeqNum, packet.AckNum, responseTcp.WindowSize)
+	return nil
+}
+
+// MSS option of a SYN or SYN+ACK, from the MTU of the link
+func (t *TeaCPConn) addMSS(packet *TCPPacket) {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(mssForMTU(t.mtu)))
+	packet.AddOption(OptionMSS, data)
+}
+
+func (t *TeaCPConn) negotiateMSS(syn *TCPPacket) {
+	if option := syn.Option(OptionMSS); option != nil && len(option.Data) >= 2 {
+		t.peerMSS = int(binary.BigEndian.Uint16(option.Data))
+	}
+}
+
+// Largest segment the link and the peer accept. The option does not count
+// the TCP options, the timestamps are taken off it (RFC 7323 section 4.2).
+func (t *TeaCPConn) sendMSS() int {
+	mss := mssForMTU(t.mtu)
+	if t.peerMSS > 0 && t.peerMSS < mss {
+		mss = t.peerMSS
+	}
+	if t.tsEnabled {
+		mss -= 12
+	}
+	return mss
+}
+
+// SYN received in SYN-SENT, both sides opened at the same time or the
+// connection is to itself (RFC 793 figure 8): our SYN becomes a SYN+ACK,
+// sent now and retransmitted by the handshake.
+func (t *TeaCPConn) simultaneousOpen(packet *TCPPacket, syn *TCPPacket) error {
+	if t.state == StateSynSent {
+		fmt.Println("Simultaneous open, SYN received in", t.state)
+		t.state = StateSynReceived
+		t.sackPermitted = syn.Option(OptionSACKPermitted) != nil
+		t.negotiateMSS(syn)
+		t.negotiateTimestamps(syn)
+
+		packet.SetFlag(FlagACK)
+		packet.AckNum = syn.SeqNum + 1
+		packet.Options = nil
+		t.addMSS(packet)
+		if t.sackPermitted {
+			packet.AddOption(OptionSACKPermitted, nil)
+		}
+		t.addTimestamps(packet)
+		packet.setACE(0)
+		t.ecnSYNReceived(syn, packet)
+	} else if syn.SeqNum+1 != packet.AckNum {
+		return nil //Not the SYN we acknowledge
+	}
+
+	_, err := t.ipConn.Write(packet.Marshall(t.localIPAddr.String(), t.remoteIPAddr.IP.String()))
+	return err
+}
+
+// Passive open from the SYN of the peer: sends the SYN+ACK and waits for the ACK
+func (t *TeaCPConn) accept(ctx context.Context, syn *TCPPacket) error {
+	t.state = StateSynReceived
+	t.sackPermitted = syn.Option(OptionSACKPermitted) != nil
+	t.negotiateMSS(syn)
+	t.initTimestamps()
+	t.negotiateTimestamps(syn)
+
+	packet := &TCPPacket{}
+	packet.SrcPort = t.sourcePort
+	packet.DestPort = t.destPort
+	packet.DataOffset = uint8(5)
+	packet.SetFlag(FlagSYN)
+	packet.SetFlag(FlagACK)
+	packet.SeqNum = uint32(rand.Int())
+	packet.AckNum = syn.SeqNum + 1
+	packet.WindowSize = uint16(4096 * 8)
+	t.addMSS(packet)
+	if t.sackPermitted {
+		packet.AddOption(OptionSACKPermitted, nil)
+	}
+	t.addTimestamps(packet)
+	t.ecnSYNReceived(syn, packet)
+
+	//Receive ACK
+	responseTcp, err := t.handshake(ctx, packet, func(responseTcp *TCPPacket) (bool, error) {
+		if responseTcp.HasFlag(FlagRST) {
+			if responseTcp.SeqNum == packet.AckNum {
+				return false, syscall.ECONNRESET
+			}
+			return false, nil
+		}
+		if !responseTcp.HasFlag(FlagACK) {
+			return false, nil //Retransmitted SYN, the next timeout resends the SYN+ACK
+		}
+		if responseTcp.AckNum != packet.SeqNum+1 {
+			t.sendReset(responseTcp)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			//Aborted, the peer may already consider the connection established
+			reset := &TCPPacket{SrcPort: t.sourcePort, DestPort: t.destPort, SeqNum: packet.SeqNum + 1, DataOffset: 5}
+			reset.SetFlag(FlagRST)
+			t.ipConn.Write(reset.Marshall(t.localIPAddr.String(), t.remoteIPAddr.IP.String()))
+		}
+		t.state = StateClosed
+		t.ipConn.Close()
+		return err
+	}
+
+	t.establish(packet.SeqNum+1, packet.AckNum, responseTcp.WindowSize)
+
+	//The ACK completing the handshake may already carry data
+	if len(responseTcp.Data) > 0 {
+		responseTcp.handshakeACK = true
+		t.handlePacket(responseTcp, ECNNotECT)
+	}
+	return nil
+}
+
+// Initializes the synchronized connection and starts its goroutines
+func (t *TeaCPConn) establish(localSeq, remoteSeq uint32, remoteWindow uint16) {
+	t.remoteSeqNumber = remoteSeq
+	t.localSeqNumber = localSeq
+	t.lastSentAck = remoteSeq
 	t.lastReceivedAck = t.localSeqNumber
-	t.ackWaitingBuffer = make([]*TCPPacket, 10)
+	t.mss = t.sendMSS()
+	t.remoteWindow = int(remoteWindow)
+	t.cc, _ = NewCongestionControl(defaultCongestionControl, t.mss)
+	t.rtt = newRTTEstimator()
+	t.pacer.mss = t.mss
+	t.updatePacingRate()
+	t.delayedAck = defaultDelayedAck
+	t.keepAlive = KeepAliveConfig{
+		Idle:     defaultKeepAliveIdle,
+		Interval: defaultKeepAliveInterval,
+		Count:    defaultKeepAliveCount}
+	t.lastReceived = time.Now()
+	t.scoreboard.reset(t.localSeqNumber)
 	t.rcvBuffer = new(bytes.Buffer)
+	t.rcvMark = -1
 	t.sendCond = sync.NewCond(new(sync.Mutex))
 	t.rcvBufferCon = sync.NewCond(new(sync.Mutex))
+	t.state = StateEstablished
 
 	go t.packerSender()
 	go t.packetsReceiver()
+}
 
-	return nil
+// Sends a handshake segment, retransmitted with an exponential backoff, until
+// accept returns true for a segment of the peer or an error.
+func (t *TeaCPConn) handshake(ctx context.Context, packet *TCPPacket, accept func(*TCPPacket) (bool, error)) (*TCPPacket, error) {
+	rto := t.synRTO
+	if rto == 0 {
+		rto = initialRTO
+	}
+	retries := 0
+	var softErr error //Transient ICMP error, reported if the handshake times out
+
+	//Reads are interrupted at each retransmission deadline and when ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			setReadDeadline(t.ipConn, time.Now())
+		case <-stop:
+		}
+	}()
+	defer setReadDeadline(t.ipConn, time.Time{})
+
+	buffer := make([]byte, 4096*16)
+	for {
+		//Marshalled at each attempt, accept can turn the segment into another one
+		b := packet.Marshall(t.localIPAddr.String(), t.remoteIPAddr.IP.String())
+		length, err := t.ipConn.Write(b)
+		if err != nil {
+			fmt.Println("Error while sending handshake TCP Packet:", err)
+			return nil, err
+		}
+		fmt.Printf("%d bytes sent (TCP Seq:%d, Ack:%d)\n", length, packet.SeqNum, packet.AckNum)
+
+		deadline := time.Now().Add(rto)
+		setReadDeadline(t.ipConn, deadline)
+		for time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+			}
+
+			length, err = t.ipConn.Read(buffer)
+			if err == ErrReadTimeout {
+				continue
+			}
+			if unreachable, ok := err.(*ICMPUnreachableError); ok {
+				if unreachable.SrcPort != t.sourcePort || unreachable.DestPort != t.destPort {
+					continue
+				}
+				if !unreachable.Soft() {
+					return nil, unreachable
+				}
+				softErr = unreachable
+				continue
+			}
+			if err != nil {
+				fmt.Println("Error while reading tun interface", err)
+				return nil, err
+			}
+			fmt.Println(length, "bytes read")
+
+			responseTcp := NewTCPPacket(buffer[:length])
+			fmt.Println("")
+			fmt.Println("TCP Packet")
+			fmt.Println(responseTcp.String())
+
+			if responseTcp.SrcPort != t.destPort || responseTcp.DestPort != t.sourcePort {
+				continue
+			}
+
+			done, err := accept(responseTcp)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return responseTcp, nil
+			}
+		}
+
+		if retries == maxSYNRetries {
+			if softErr != nil {
+				return nil, softErr
+			}
+			return nil, syscall.ETIMEDOUT
+		}
+		retries++
+		rto *= 2
+		fmt.Println("Handshake retransmission", retries, "next timeout", rto)
+	}
+}
+
+// RST answering an unacceptable segment (RFC 793 "Reset Generation")
+func resetFor(to *TCPPacket) *TCPPacket {
+	packet := &TCPPacket{}
+	packet.SrcPort = to.DestPort
+	packet.DestPort = to.SrcPort
+	packet.DataOffset = uint8(5)
+	packet.SetFlag(FlagRST)
+	if to.HasFlag(FlagACK) {
+		packet.SeqNum = to.AckNum
+	} else {
+		packet.SetFlag(FlagACK)
+		packet.AckNum = to.SeqNum + uint32(len(to.Data))
+		if to.HasFlag(FlagSYN) {
+			packet.AckNum++
+		}
+	}
+	return packet
+}
+
+func (t *TeaCPConn) sendReset(to *TCPPacket) {
+	packet := resetFor(to)
+	_, err := t.ipConn.Write(packet.Marshall(t.localIPAddr.String(), t.remoteIPAddr.IP.String()))
+	if err != nil {
+		fmt.Println("Error while sending RST TCP Packet:", err)
+	}
 }
 
 func (t *TeaCPConn) packerSender() {
 	localIp, remotetIp := t.localIPAddr.String(), t.remoteIPAddr.String()
+	batchConn, batching := t.ipConn.(BatchConn)
 
 	fmt.Println("O: packet sender started")
 	for {
 		t.sendCond.L.Lock()
-		var flags uint16
+		var retransmit *TCPPacket
 		var payload []byte
+		probe := false
 
 		for {
-			if t.remoteSeqNumber > t.lastSentAck {
-				fmt.Println("O: remote seq num incremented. Send ack")
-				flags = (1 << FlagACK)
+			if t.err != nil {
+				t.batch = nil
+				t.sendCond.L.Unlock()
+				fmt.Println("O: packet sender stopped")
+				return
+			}
+
+			paced := t.paced()
+			if paced {
+				if retransmit = t.nextRetransmission(); retransmit != nil {
+					fmt.Println("O: retransmission of seq", retransmit.SeqNum)
+					break
+				} else if length := t.nextSegmentLength(); length > 0 && t.canSend(length) {
+					payload = make([]byte, length)
+					copy(payload, t.sendBuffer)
+					t.sendBuffer = t.sendBuffer[length:]
+					break
+				}
+			}
+			if t.keepAliveProbe {
+				probe = true
 				break
-			} else if len(t.sendBuffer) > 0 {
-				payload, t.sendBuffer = t.sendBuffer[len(t.sendBuffer)-1], t.sendBuffer[:len(t.sendBuffer)-1]
+			}
+			if t.ackNow {
+				fmt.Println("O: remote seq num incremented. Send ack")
 				break
 			}
+			if len(t.batch) > 0 {
+				t.flushBatch(batchConn) //Nothing more to send for now
+				continue
+			}
 			t.sendCond.Wait()
 		}
+
+		var p *TCPPacket
+		t.batching = batching
+		if retransmit != nil {
+			p = t.retransmitPacket(retransmit, localIp, remotetIp)
+		} else if probe {
+			p = t.sendKeepAliveProbe(localIp, remotetIp)
+		} else {
+			p = t.sendPacket(1<<FlagACK, payload, localIp, remotetIp)
+		}
+		t.batching = false
+		if len(t.batch) >= maxBatchSegments {
+			t.flushBatch(batchConn)
+		}
 		t.sendCond.L.Unlock()
 
-		p := t.sendPacket(flags, payload, localIp, remotetIp)
 		fmt.Println("O: Packet sent")
 		fmt.Println(p)
 	}
 }
 
+// Writes the queued segments with as few system calls as the link allows.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) flushBatch(conn BatchConn) {
+	n, err := conn.WriteBatch(t.batch)
+	if err != nil {
+		fmt.Println("Failed to send", len(t.batch)-n, "segments due to error: ", err)
+	}
+	t.batch = t.batch[:0]
+}
+
+// Returns true if the pacing rate allows a segment to be sent now,
+// otherwise the sender is woken up when it does.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) paced() bool {
+	wait := t.pacer.delay(time.Now())
+	if wait <= 0 {
+		return true
+	}
+	if t.pacingTimer == nil {
+		t.pacingTimer = time.AfterFunc(wait, func() {
+			t.sendCond.L.Lock()
+			t.pacingTimer = nil
+			t.sendCond.Signal()
+			t.sendCond.L.Unlock()
+		})
+	}
+	return false
+}
+
+// Pacing rate given by the congestion control. Algorithms without their own
+// model are paced at twice cwnd per smoothed RTT to avoid bursts.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) updatePacingRate() {
+	t.pacer.ccRate = 0
+	if paced, ok := t.cc.(PacedCongestionControl); ok {
+		t.pacer.ccRate = paced.PacingRate()
+	} else if t.rtt.srtt > 0 {
+		t.pacer.ccRate = 2 * float64(t.cc.CongestionWindow()) / t.rtt.srtt.Seconds()
+	}
+}
+
+// Size of the next new segment, 0 if nothing should be sent yet.
+// Small segments are held while corked, or by Nagle's algorithm (RFC 896)
+// while data is unacknowledged.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) nextSegmentLength() int {
+	length := len(t.sendBuffer)
+	if length >= t.mss {
+		return t.mss
+	}
+	if length == 0 || t.sndUrgentPending {
+		return length
+	}
+	if t.corked {
+		return 0
+	}
+	if !t.noDelay && t.localSeqNumber != t.lastReceivedAck {
+		return 0
+	}
+	return length
+}
+
+// Must be called with sendCond.L held
+func (t *TeaCPConn) canSend(length int) bool {
+	flight := int(t.localSeqNumber - t.lastReceivedAck)
+	if flight+length > t.remoteWindow {
+		return false
+	}
+
+	if t.scoreboard.inRecovery {
+		return t.cc.CongestionWindow()-t.pipe() >= length
+	}
+	return flight+length <= t.cc.CongestionWindow()
+}
+
+// Bytes in flight. With SACK the scoreboard gives the estimation, without
+// it each duplicate ACK is counted as a segment that left the network.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) pipe() int {
+	s := &t.scoreboard
+	if t.sackPermitted || s.rtoLoss {
+		return s.pipe(t.ackWaitingBuffer, t.mss)
+	}
+
+	pipe := int(t.localSeqNumber-t.lastReceivedAck) - s.dupAcks*t.mss
+	if seqGT(s.highRxt, s.highACK) {
+		pipe += int(s.highRxt - s.highACK)
+	}
+	if pipe < 0 {
+		pipe = 0
+	}
+	return pipe
+}
+
+// NextSeg() of RFC 6675. Must be called with sendCond.L held
+func (t *TeaCPConn) nextRetransmission() *TCPPacket {
+	if len(t.ackWaitingBuffer) == 0 {
+		return nil
+	}
+
+	s := &t.scoreboard
+	if t.fastRetransmit {
+		t.fastRetransmit = false
+		return t.ackWaitingBuffer[0]
+	}
+
+	if !s.inRecovery || t.cc.CongestionWindow()-t.pipe() < t.mss {
+		return nil
+	}
+
+	if p := s.nextSeg(t.ackWaitingBuffer, t.mss); p != nil {
+		return p
+	}
+	if length := t.nextSegmentLength(); length > 0 && int(t.localSeqNumber-t.lastReceivedAck)+length <= t.remoteWindow {
+		return nil //New data first
+	}
+	if p := s.nextUnSACKed(t.ackWaitingBuffer); p != nil {
+		return p
+	}
+	return s.rescueSeg(t.ackWaitingBuffer)
+}
+
 func (t *TeaCPConn) sendPacket(flags uint16, payload []byte, localIp, remotetIp string) *TCPPacket {
 	packet := &TCPPacket{}
 	packet.SrcPort = t.sourcePort
@@ -171,120 +732,483 @@ func (t *TeaCPConn) sendPacket(flags uint16, payload []byte, localIp, remotetIp
 	packet.DataOffset = uint8(5)
 	packet.SeqNum = t.localSeqNumber
 	packet.AckNum = t.remoteSeqNumber
-	packet.WindowSize = uint16(4096 * 8)
+	packet.WindowSize = uint16(receiveWindow)
 
 	packet.Flags = flags
 	packet.Data = payload
+	t.addOptions(packet)
+	if t.advertiseUserTimeout {
+		packet.AddOption(OptionUserTimeout, encodeUserTimeout(t.userTimeout))
+		t.advertiseUserTimeout = false
+	}
+	t.markUrgent(packet)
+	ecn := t.markECN(packet, false)
 
 	b := packet.Marshall(localIp, remotetIp)
-	_, err := t.ipConn.Write(b)
+	_, err := t.writeSegment(b, ecn)
 	if err != nil {
 		fmt.Println("Failed to send packet with seq", t.localSeqNumber, " due to error: ", err)
 		//What to do ?
 	} else {
 		//start timeout timer
 		if packet.HasFlag(FlagACK) {
-			t.lastSentAck = packet.AckNum
+			t.ackSent(packet.AckNum)
+		}
+	}
+
+	if packet.Data != nil {
+		t.localSeqNumber = t.localSeqNumber + uint32(len(packet.Data))
+		t.scoreboard.highData = t.localSeqNumber
+		t.ackWaitingBuffer = append(t.ackWaitingBuffer, packet)
+		if len(t.ackWaitingBuffer) == 1 {
+			t.unackedSince = time.Now()
+			t.armUserTimeout()
 		}
 
-		if packet.Data != nil {
-			t.localSeqNumber = t.localSeqNumber + uint32(len(packet.Data))
+		t.pacer.consume(len(packet.Data))
+		if !t.rttTiming {
+			t.rttTiming = true
+			t.rttSeq = t.localSeqNumber
+			t.rttStart = time.Now()
 		}
+		if t.rtoTimer == nil {
+			t.startRTOTimer()
+		}
+	}
+
+	return packet
+}
+
+// Timestamps and SACK blocks of a data or ACK segment.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) addOptions(packet *TCPPacket) {
+	t.addTimestamps(packet)
+	if t.sackPermitted && len(t.oooRcvPackets) > 0 {
+		max := maxSACKBlocks
+		if t.tsEnabled {
+			max = maxSACKBlocksWithTimestamps
+		}
+		packet.AddSACKBlocks(sackBlocksFromQueue(t.oooRcvPackets, t.lastOOOSeqNum, max))
+	}
+}
+
+// An ACK was sent, standalone or piggybacked on data.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) ackSent(ack uint32) {
+	t.lastSentAck = ack
+	t.ackNow = false
+	if t.delayedAckTimer != nil {
+		t.delayedAckTimer.Stop()
+		t.delayedAckTimer = nil
+	}
+}
+
+// Delayed ACKs (RFC 1122): every second full segment is acknowledged at once,
+// otherwise the ACK waits for outgoing data or the delayed ACK timeout.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) scheduleAck(push bool) {
+	if t.ackNow {
+		return
+	}
+	if push || t.delayedAck == 0 || int(t.remoteSeqNumber-t.lastSentAck) >= 2*t.mss {
+		t.ackNow = true
+		return
+	}
+
+	if t.delayedAckTimer == nil {
+		t.delayedAckTimer = time.AfterFunc(t.delayedAck, func() {
+			t.sendCond.L.Lock()
+			t.delayedAckTimer = nil
+			if seqGT(t.remoteSeqNumber, t.lastSentAck) {
+				t.ackNow = true
+				t.sendCond.Signal()
+			}
+			t.sendCond.L.Unlock()
+		})
 	}
+}
+
+// Must be called with sendCond.L held
+func (t *TeaCPConn) startRTOTimer() {
+	if t.rtoTimer != nil {
+		t.rtoTimer.Stop()
+	}
+	t.rtoTimer = time.AfterFunc(t.rtt.rto, t.onRTO)
+}
+
+// Must be called with sendCond.L held
+func (t *TeaCPConn) stopRTOTimer() {
+	if t.rtoTimer != nil {
+		t.rtoTimer.Stop()
+		t.rtoTimer = nil
+	}
+}
+
+func (t *TeaCPConn) onRTO() {
+	t.sendCond.L.Lock()
+	defer t.sendCond.L.Unlock()
+
+	t.rtoTimer = nil
+	if len(t.ackWaitingBuffer) == 0 {
+		return
+	}
+
+	fmt.Println("O: retransmission timeout, rto", t.rtt.rto)
+	t.cc.OnRTO(int(t.localSeqNumber - t.lastReceivedAck))
+	t.rtt.backoff()
+	t.rttTiming = false
+	t.scoreboard.enterRTORecovery()
+	t.fastRetransmit = true
+	t.updatePacingRate()
+	t.startRTOTimer()
+	t.sendCond.Signal()
+}
 
+func (t *TeaCPConn) retransmitPacket(packet *TCPPacket, localIp, remotetIp string) *TCPPacket {
+	packet.AckNum = t.remoteSeqNumber
+	packet.Options = nil
+	t.addOptions(packet)
+	ecn := t.markECN(packet, true)
+
+	b := packet.Marshall(localIp, remotetIp)
+	_, err := t.writeSegment(b, ecn)
+	if err != nil {
+		fmt.Println("Failed to retransmit packet with seq", packet.SeqNum, " due to error: ", err)
+		return packet
+	}
+
+	t.ackSent(packet.AckNum)
+	t.pacer.consume(len(packet.Data))
+	end := packet.SeqNum + uint32(len(packet.Data))
+	if seqGT(end, t.scoreboard.highRxt) {
+		t.scoreboard.highRxt = end
+	}
+	if t.rttTiming && seqGEQ(t.rttSeq, packet.SeqNum) {
+		t.rttTiming = false //Karn's algorithm
+	}
 	return packet
 }
 
+// Must be called with sendCond.L held
+func (t *TeaCPConn) processAck(packet *TCPPacket) {
+	ack := packet.AckNum
+	if seqGT(ack, t.localSeqNumber) {
+		fmt.Println("I: ACK for data not yet sent", ack)
+		t.ackNow = true
+		return
+	}
+	t.remoteWindow = int(packet.WindowSize)
+
+	var blocks []sackBlock
+	if t.sackPermitted {
+		blocks = packet.SACKBlocks()
+	}
+	s := &t.scoreboard
+	newSACK := s.update(ack, blocks)
+
+	if seqGT(ack, t.lastReceivedAck) {
+		acked := int(ack - t.lastReceivedAck)
+		inFlight := int(t.localSeqNumber - t.lastReceivedAck)
+		t.lastReceivedAck = ack
+		if t.sndUrgentPending && seqGEQ(ack, t.sndUrgentPointer) {
+			t.sndUrgentPending = false //Urgent data acknowledged, leave urgent mode
+		}
+		for len(t.ackWaitingBuffer) > 0 {
+			p := t.ackWaitingBuffer[0]
+			if seqGT(p.SeqNum+uint32(len(p.Data)), ack) {
+				break
+			}
+			t.ackWaitingBuffer = t.ackWaitingBuffer[1:]
+		}
+		s.dupAcks = 0
+
+		rtt, sampled := t.timestampRTT(packet)
+		if t.rttTiming && seqGEQ(ack, t.rttSeq) {
+			t.rttTiming = false
+			if !sampled {
+				rtt, sampled = time.Since(t.rttStart), true
+			}
+		}
+		if sampled {
+			t.rtt.sample(rtt)
+		}
+		if len(t.ackWaitingBuffer) > 0 {
+			t.startRTOTimer()
+		} else {
+			t.stopRTOTimer()
+		}
+		t.unackedSince = time.Now()
+		t.armUserTimeout()
+
+		if s.inRecovery && seqGEQ(ack, s.recoveryPoint) {
+			fmt.Println("I: end of loss recovery")
+			s.inRecovery = false
+			s.rtoLoss = false
+		} else if s.inRecovery && !t.sackPermitted && !s.rtoLoss {
+			//NewReno partial ACK: the next hole is lost too (RFC 6582)
+			t.fastRetransmit = true
+		}
+
+		if !s.inRecovery || s.rtoLoss {
+			t.cc.OnAck(acked, rtt, inFlight)
+		}
+	} else if ack == t.lastReceivedAck && len(packet.Data) == 0 && len(t.ackWaitingBuffer) > 0 {
+		if !t.sackPermitted || newSACK {
+			s.dupAcks++
+			fmt.Println("I: duplicate ACK", s.dupAcks)
+		}
+	}
+
+	if !s.inRecovery && len(t.ackWaitingBuffer) > 0 &&
+		(s.dupAcks >= dupThresh || (t.sackPermitted && s.isLost(s.highACK, t.mss))) {
+		fmt.Println("I: entering loss recovery")
+		t.cc.OnLoss(int(t.localSeqNumber - t.lastReceivedAck))
+		s.enterRecovery()
+		t.fastRetransmit = true
+	}
+	t.updatePacingRate()
+}
+
+// Handles the payload of an incoming packet and returns the data that can be
+// delivered in order. Must be called with sendCond.L held
+func (t *TeaCPConn) receiveData(packet *TCPPacket) []byte {
+	if len(packet.Data) == 0 {
+		if seqLT(packet.SeqNum, t.remoteSeqNumber) {
+			t.ackNow = true //Unacceptable segment, like a keep-alive probe (RFC 1122 4.2.3.6)
+		}
+		return nil
+	}
+
+	end := packet.SeqNum + uint32(len(packet.Data))
+	if seqLEQ(end, t.remoteSeqNumber) {
+		fmt.Println("I: Duplicate package. Retransmission ?")
+		t.ackNow = true
+		return nil
+	}
+
+	if seqGT(packet.SeqNum, t.remoteSeqNumber) {
+		fmt.Println("I: Out of order packet")
+		t.queueOutOfOrder(packet)
+		t.ackNow = true
+		return nil
+	}
+
+	data := packet.Data[t.remoteSeqNumber-packet.SeqNum:]
+	t.remoteSeqNumber = end
+
+	if len(t.oooRcvPackets) > 0 {
+		t.ackNow = true //A hole was filled
+	}
+	for len(t.oooRcvPackets) > 0 {
+		ooopacket := t.oooRcvPackets[0]
+		if seqGT(ooopacket.SeqNum, t.remoteSeqNumber) {
+			break
+		}
+		oooEnd := ooopacket.SeqNum + uint32(len(ooopacket.Data))
+		if seqGT(oooEnd, t.remoteSeqNumber) {
+			data = append(data, ooopacket.Data[t.remoteSeqNumber-ooopacket.SeqNum:]...)
+			t.remoteSeqNumber = oooEnd
+		}
+		t.oooRcvPackets = t.oooRcvPackets[1:]
+	}
+
+	t.scheduleAck(packet.HasFlag(FlagPSH))
+	return data
+}
+
+func (t *TeaCPConn) queueOutOfOrder(packet *TCPPacket) {
+	t.lastOOOSeqNum = packet.SeqNum
+	packet.Data = append([]byte(nil), packet.Data...) //The read buffer is reused
+
+	index := len(t.oooRcvPackets)
+	for i, p := range t.oooRcvPackets {
+		if p.SeqNum == packet.SeqNum && len(p.Data) >= len(packet.Data) {
+			return //Already queued
+		}
+		if seqLEQ(packet.SeqNum, p.SeqNum) {
+			index = i
+			break
+		}
+	}
+
+	t.oooRcvPackets = append(t.oooRcvPackets, nil)
+	copy(t.oooRcvPackets[index+1:], t.oooRcvPackets[index:])
+	t.oooRcvPackets[index] = packet
+}
+
 func (t *TeaCPConn) packetsReceiver() {
 	//windowSize := 65535
 
-	b := make([]byte, 65535)
+	batchConn, batching := t.ipConn.(BatchConn)
+	segments := make([]Segment, 1)
+	if batching {
+		segments = make([]Segment, readBatchSegments)
+	}
+	for i := range segments {
+		segments[i].Data = make([]byte, 65535) //Reused, nothing keeps a reference on it
+	}
 
 	fmt.Println("I: packet sender started")
 	for {
-		n, err := t.ipConn.Read(b)
+		t.sendCond.L.Lock()
+		err := t.err
+		t.sendCond.L.Unlock()
+		if err != nil {
+			t.ipConn.Close()
+			fmt.Println("I: packet receiver stopped")
+			return
+		}
+
+		n := 1
+		if batching {
+			n, err = batchConn.ReadBatch(segments)
+		} else {
+			err = t.readSegment(&segments[0])
+		}
+		if unreachable, ok := err.(*ICMPUnreachableError); ok {
+			if unreachable.SrcPort == t.sourcePort && unreachable.DestPort == t.destPort && !unreachable.Soft() {
+				t.abort(unreachable)
+			}
+			continue
+		}
 		if err != nil {
 			//close ?
 			fmt.Println("IP Read error", err)
 			continue
 		}
-		fmt.Println("I: ", n, "bytes read from ip connection")
+		for _, segment := range segments[:n] {
+			fmt.Println("I: ", len(segment.Data), "bytes read from ip connection")
 
-		packet := NewTCPPacket(b)
-		fmt.Println("I: New packet received")
-		fmt.Println(packet)
+			packet := NewTCPPacket(segment.Data)
+			fmt.Println("I: New packet received")
+			fmt.Println(packet)
 
-		if packet.HasFlag(FlagRST) {
-			fmt.Println("I: RST flag received")
-			//Clear buffer
-			//Send ACK + RST
-			return
+			t.handlePacket(packet, segment.ECN)
 		}
+	}
 
-		if packet.SeqNum < t.remoteSeqNumber {
-			fmt.Println("I: Duplicate package. Retransmission ?")
-			continue // duplicate packet. Drop it
-		}
+}
 
-		if packet.HasFlag(FlagACK) {
-			fmt.Println("I: ACK flag received")
-			//var clean []*TCPPacket
-			//for index, p := range t.ackWaitingBuffer {
-			//	if (p.SeqNum + uint32(len(packet.Data))) > packet.AckNum {
-			//		clean = append(clean, p)
-			//	}
-			//}
-			//t.ackWaitingBuffer = clean
-
-			////TODO
-			//if len(packet.Data) == 0 {
-			//	continue //Just an ACK packet, no reason to keep it
-			//}
-		}
-
-		if packet.SeqNum > t.remoteSeqNumber {
-			fmt.Println("I: Out of order packet")
-			//t.oooRcvPackets = append(t.oooRcvPackets, packet) //TODO check rcv + ooo size first
-			continue
+// Processing of a segment received in synchronized state, ecn is the
+// codepoint of its IP header
+func (t *TeaCPConn) handlePacket(packet *TCPPacket, ecn uint8) {
+	if packet.SrcPort != t.destPort || packet.DestPort != t.sourcePort {
+		return //Segment of another connection sharing the link
+	}
+	t.sendCond.L.Lock()
+	t.keepAliveReceived()
+	if option := packet.Option(OptionUserTimeout); option != nil {
+		t.receivedUserTimeout(option)
+	}
+	if packet.HasFlag(FlagRST) {
+		fmt.Println("I: RST flag received")
+		reset := t.acceptableReset(packet)
+		t.sendCond.Signal()
+		t.sendCond.L.Unlock()
+		if reset {
+			t.abort(syscall.ECONNRESET)
 		}
+		return
+	}
 
-		t.rcvBufferCon.L.Lock()
-		l, err := t.rcvBuffer.Write(packet.Data)
-		if err != nil {
-			fmt.Println("I: Error while writing packet data into buffer")
-		} else {
-			fmt.Println("I: ", l, "bytes writed into rcvBuffer")
-			t.rcvBufferCon.Signal()
-		}
-		t.rcvBufferCon.L.Unlock()
+	if !t.checkTimestamps(packet) {
+		t.sendCond.Signal()
+		t.sendCond.L.Unlock()
+		return
+	}
 
-		t.sendCond.L.Lock()
-		t.remoteSeqNumber = t.remoteSeqNumber + uint32(len(packet.Data))
-		fmt.Println("I: new remote seq num", t.remoteSeqNumber)
-		t.sendCond.Signal() //signal that new ack should be send
+	if packet.HasFlag(FlagSYN) && t.state.synchronized() {
+		fmt.Println("I: SYN in synchronized state, challenge ACK")
+		t.ackNow = true //RFC 5961 section 4
+		t.sendCond.Signal()
 		t.sendCond.L.Unlock()
+		return
+	}
 
-		//if len(t.oooRcvPackets) > 0 {
-		//	index := 0
-		//	for {
-		//		if index >= len(t.oooRcvPackets) {
-		//			break
-		//		}
+	if packet.HasFlag(FlagACK) {
+		fmt.Println("I: ACK flag received")
+		t.processAck(packet)
+	}
+	t.receivedECN(packet, ecn)
 
-		//		ooopacket := t.oooRcvPackets[index]
-		//		if ooopacket.SeqNum == t.remoteSeqNumber {
-		//			t.rcvBuffer = append(t.rcvBuffer, ooopacket)
-		//			t.remoteSeqNumber = t.remoteSeqNumber + uint32(len(ooopacket.Data))
-		//			t.oooRcvPackets = append(t.oooRcvPackets[:index], t.oooRcvPackets[index+1:]...)
-		//			index = 0
-		//		} else {
-		//			index++
-		//		}
-		//	}
-		//}
+	t.receivedUrgent(packet)
+	start := t.remoteSeqNumber
+	urgentSeq, urgent := t.rcvUrgentPointer-1, t.rcvUrgentPending
+	data := t.receiveData(packet)
+	if urgent && seqGEQ(t.remoteSeqNumber, t.rcvUrgentPointer) {
+		t.rcvUrgentPending = false //The urgent byte is in data
+	}
+	fmt.Println("I: new remote seq num", t.remoteSeqNumber)
+	t.sendCond.Signal() //signal that new ack or data should be send
+	t.sendCond.L.Unlock()
 
+	if len(data) == 0 {
+		return
 	}
 
+	t.rcvBufferCon.L.Lock()
+	t.bufferData(data, start, urgentSeq, urgent)
+	fmt.Println("I: ", len(data), "bytes writed into rcvBuffer")
+	t.rcvBufferCon.Signal()
+	t.rcvBufferCon.L.Unlock()
+}
+
+// RST sequence validation (RFC 5961 section 3): the connection is reset only
+// if the sequence number is exactly the next expected one. An in-window RST
+// gets a challenge ACK, anything else is dropped.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) acceptableReset(packet *TCPPacket) bool {
+	if packet.SeqNum == t.remoteSeqNumber {
+		return true
+	}
+
+	if seqGT(packet.SeqNum, t.remoteSeqNumber) && seqLT(packet.SeqNum, t.remoteSeqNumber+receiveWindow) {
+		fmt.Println("I: RST in window, challenge ACK")
+		t.ackNow = true
+	}
+	return false
+}
+
+// Aborts the connection: pending and future Read/Write calls fail with err
+// and both goroutines stop.
+func (t *TeaCPConn) abort(err error) {
+	t.sendCond.L.Lock()
+	if t.err != nil {
+		t.sendCond.L.Unlock()
+		return
+	}
+	fmt.Println("Connection aborted in state", t.state, ":", err)
+	t.err = err
+	t.state = StateClosed
+	setReadDeadline(t.ipConn, time.Now()) //Wakes up the receiver, it closes ipConn
+	t.sendBuffer = nil
+	t.ackWaitingBuffer = nil
+	t.oooRcvPackets = nil
+	t.stopRTOTimer()
+	if t.delayedAckTimer != nil {
+		t.delayedAckTimer.Stop()
+	}
+	if t.pacingTimer != nil {
+		t.pacingTimer.Stop()
+	}
+	if t.keepAliveTimer != nil {
+		t.keepAliveTimer.Stop()
+	}
+	if t.userTimeoutTimer != nil {
+		t.userTimeoutTimer.Stop()
+	}
+	t.sendCond.Broadcast()
+	t.sendCond.L.Unlock()
+
+	t.rcvBufferCon.L.Lock()
+	t.rcvErr = err
+	t.rcvBuffer.Reset()
+	t.rcvBufferCon.Broadcast()
+	t.rcvBufferCon.L.Unlock()
+}
+
+func (t *TeaCPConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "teacp", Source: t.localIPAddr, Addr: t.remoteIPAddr, Err: err}
 }
 
 // func sortQueue(q *list.List) {
@@ -309,13 +1233,116 @@ func (t *TeaCPConn) Close() {
 
 }
 
+// Aborts the connection by sending a RST to the peer
+func (t *TeaCPConn) Abort() error {
+	t.sendCond.L.Lock()
+	if t.err != nil {
+		err := t.err
+		t.sendCond.L.Unlock()
+		return t.opError("abort", err)
+	}
+	if t.state.synchronized() {
+		t.sendPacket(1<<FlagRST, nil, t.localIPAddr.String(), t.remoteIPAddr.String())
+	}
+	t.sendCond.L.Unlock()
+
+	t.abort(net.ErrClosed)
+	return nil
+}
+
+// Selects the congestion control algorithm of the connection ("newreno", "cubic", "bbr")
+func (t *TeaCPConn) SetCongestionControl(name string) error {
+	cc, err := NewCongestionControl(name, t.mss)
+	if err != nil {
+		return err
+	}
+
+	t.sendCond.L.Lock()
+	t.cc = cc
+	t.updatePacingRate()
+	t.sendCond.L.Unlock()
+	return nil
+}
+
+// Caps the pacing rate of the connection in bytes per second, 0 removes the cap
+func (t *TeaCPConn) SetMaxPacingRate(bytesPerSecond float64) {
+	t.sendCond.L.Lock()
+	t.pacer.maxRate = bytesPerSecond
+	t.sendCond.L.Unlock()
+}
+
+// Current pacing rate in bytes per second, 0 when the output is not paced
+func (t *TeaCPConn) PacingRate() float64 {
+	t.sendCond.L.Lock()
+	defer t.sendCond.L.Unlock()
+	return t.pacer.rate()
+}
+
+// Sets the delayed ACK timeout, capped at 500ms. 0 acknowledges every segment at once.
+func (t *TeaCPConn) SetDelayedAck(timeout time.Duration) {
+	if timeout > maxDelayedAck {
+		timeout = maxDelayedAck
+	}
+
+	t.sendCond.L.Lock()
+	t.delayedAck = timeout
+	t.sendCond.L.Unlock()
+}
+
+// Disables Nagle's algorithm when noDelay is true, as *net.TCPConn
+func (t *TeaCPConn) SetNoDelay(noDelay bool) error {
+	t.sendCond.L.Lock()
+	t.noDelay = noDelay
+	t.sendCond.Signal()
+	t.sendCond.L.Unlock()
+	return nil
+}
+
+// While corked only full segments are sent, partial ones wait for SetCork(false)
+func (t *TeaCPConn) SetCork(cork bool) error {
+	t.sendCond.L.Lock()
+	t.corked = cork
+	t.sendCond.Signal()
+	t.sendCond.L.Unlock()
+	return nil
+}
+
+func (t *TeaCPConn) Write(b []byte) (n int, err error) {
+	t.sendCond.L.Lock()
+	if t.err != nil {
+		err := t.err
+		t.sendCond.L.Unlock()
+		return 0, t.opError("write", err)
+	}
+	t.sendBuffer = append(t.sendBuffer, b...)
+	t.sendCond.Signal()
+	t.sendCond.L.Unlock()
+
+	return len(b), nil
+}
+
 func (t *TeaCPConn) Read(b []byte) (n int, err error) {
 	t.rcvBufferCon.L.Lock()
-	if t.rcvBuffer.Len() == 0 {
+	for t.rcvBuffer.Len() == 0 && t.rcvErr == nil {
 		t.rcvBufferCon.Wait()
 	}
 
+	if t.rcvBuffer.Len() == 0 {
+		err = t.rcvErr
+		t.rcvBufferCon.L.Unlock()
+		return 0, t.opError("read", err)
+	}
+
+	if t.rcvMark > 0 && len(b) > t.rcvMark {
+		b = b[:t.rcvMark] //Reads stop at the urgent mark
+	}
 	n, err = t.rcvBuffer.Read(b)
+	if t.rcvMark >= 0 {
+		t.rcvMark -= n
+		if t.rcvMark < 0 {
+			t.rcvMark = -1
+		}
+	}
 	t.rcvBufferCon.L.Unlock()
 
 	return n, err
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Loopback endpoint recording the flags of the segments it sends
+type recordingLink struct {
+	*LoopbackIPConn
+
+	mu    sync.Mutex
+	flags []uint16
+}
+
+func (l *recordingLink) record(b []byte) {
+	l.mu.Lock()
+	l.flags = append(l.flags, NewTCPPacket(b).Flags)
+	l.mu.Unlock()
+}
+
+func (l *recordingLink) Write(b []byte) (n int, err error) {
+	l.record(b)
+	return l.LoopbackIPConn.Write(b)
+}
+
+func (l *recordingLink) WriteECN(b []byte, ecn uint8) (n int, err error) {
+	l.record(b)
+	return l.LoopbackIPConn.WriteECN(b, ecn)
+}
+
+// A SYN+ACK is only sent by a dialer that went through SYN-RECEIVED
+func (l *recordingLink) sentSYNACK() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, flags := range l.flags {
+		if flags&(1<<FlagSYN) != 0 && flags&(1<<FlagACK) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens the endpoint bound to its ports before the dial starts, so that the
+// SYN of the other side is queued rather than answered with a RST
+func openRecordingLink(t *testing.T, localAddr, remoteAddr *net.IPAddr, localPort, remotePort uint16) (*recordingLink, LinkOpener) {
+	conn, err := OpenLoopback(localAddr, remoteAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &recordingLink{LoopbackIPConn: conn.(*LoopbackIPConn)}
+	link.bindPorts(localPort, remotePort)
+	return link, func(localAddr, remoteAddr *net.IPAddr) (LinkConn, error) {
+		return link, nil
+	}
+}
+
+func dialPort(ctx context.Context, openLink LinkOpener, localAddr, remoteAddr *net.IPAddr, localPort, remotePort uint16) (*TeaCPConn, error) {
+	return dial(ctx, &TeaCPConn{
+		localIPAddr:  localAddr,
+		remoteIPAddr: remoteAddr,
+		sourcePort:   localPort,
+		destPort:     remotePort,
+		link:         openLink})
+}
+
+// Connection dialed over the loopback interface from 127.0.0.client to
+// 127.0.0.1:port, and its accepted end. Both are aborted at the end of the
+// test, keep-alives are off.
+func loopbackPair(t *testing.T, client byte, port int) (*TeaCPConn, *TeaCPConn) {
+	serverAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, err := ListenLink(OpenLoopback, serverAddr, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &Dialer{LocalAddr: &net.IPAddr{IP: net.IPv4(127, 0, 0, client)}, KeepAlive: -1, Link: OpenLoopback}
+	dialed, err := dialer.DialContext(ctx, serverAddr, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialed.Abort() })
+	accepted, err := listener.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accepted.Abort() })
+	return dialed, accepted
+}
+
+func exchange(t *testing.T, from, to *TeaCPConn, message string) {
+	if _, err := from.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 100)
+	n, err := to.Read(b)
+	if err != nil || string(b[:n]) != message {
+		t.Fatalf("read %q, %v, want %q", b[:n], err, message)
+	}
+}
+
+func TestSimultaneousOpen(t *testing.T) {
+	addrA := &net.IPAddr{IP: net.IPv4(127, 0, 0, 10)}
+	addrB := &net.IPAddr{IP: net.IPv4(127, 0, 0, 11)}
+	linkA, openA := openRecordingLink(t, addrA, addrB, 40001, 40002)
+	linkB, openB := openRecordingLink(t, addrB, addrA, 40002, 40001)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var connA, connB *TeaCPConn
+	var errA, errB error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		connA, errA = dialPort(ctx, openA, addrA, addrB, 40001, 40002)
+	}()
+	go func() {
+		defer wg.Done()
+		connB, errB = dialPort(ctx, openB, addrB, addrA, 40002, 40001)
+	}()
+	wg.Wait()
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+	defer connA.Abort()
+	defer connB.Abort()
+
+	if !linkA.sentSYNACK() || !linkB.sentSYNACK() {
+		t.Error("a side did not go through SYN-RECEIVED")
+	}
+	if connA.state != StateEstablished || connB.state != StateEstablished {
+		t.Fatal("states", connA.state, connB.state)
+	}
+	exchange(t, connA, connB, "from A")
+	exchange(t, connB, connA, "from B")
+}
+
+func TestSelfConnect(t *testing.T) {
+	addr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 12)}
+	link, open := openRecordingLink(t, addr, addr, 40003, 40003)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialPort(ctx, open, addr, addr, 40003, 40003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Abort()
+
+	if !link.sentSYNACK() {
+		t.Error("self-connect did not go through SYN-RECEIVED")
+	}
+	if conn.state != StateEstablished {
+		t.Fatal("state", conn.state)
+	}
+	exchange(t, conn, conn, "to myself")
+}
+
+// Loopback endpoint dropping the segments it sends. Each one can be answered
+// by an ICMP destination unreachable error.
+type droppingLink struct {
+	*LoopbackIPConn
+	icmpCode int //-1 for no answer
+
+	mu      sync.Mutex
+	writes  []time.Time
+	pending error
+}
+
+func (l *droppingLink) Write(b []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writes = append(l.writes, time.Now())
+	if l.icmpCode >= 0 {
+		p := NewTCPPacket(b)
+		l.pending = &ICMPUnreachableError{Code: uint8(l.icmpCode), SrcPort: p.SrcPort, DestPort: p.DestPort}
+	}
+	return len(b), nil
+}
+
+func (l *droppingLink) Read(b []byte) (n int, err error) {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if pending != nil {
+		return 0, pending
+	}
+	return l.LoopbackIPConn.Read(b)
+}
+
+func (l *droppingLink) sent() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time(nil), l.writes...)
+}
+
+func dialDropping(t *testing.T, client byte, icmpCode int, synRTO time.Duration) (*droppingLink, error) {
+	localAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, client)}
+	remoteAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, err := OpenLoopback(localAddr, remoteAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &droppingLink{LoopbackIPConn: conn.(*LoopbackIPConn), icmpCode: icmpCode}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = dial(ctx, &TeaCPConn{
+		localIPAddr:  localAddr,
+		remoteIPAddr: remoteAddr,
+		sourcePort:   40033,
+		destPort:     7033,
+		synRTO:       synRTO,
+		link: func(localAddr, remoteAddr *net.IPAddr) (LinkConn, error) {
+			return link, nil
+		}})
+	return link, err
+}
+
+// The SYN is retransmitted maxSYNRetries times with an exponential backoff
+func TestSYNRetransmissions(t *testing.T) {
+	const rto = 20 * time.Millisecond
+	link, err := dialDropping(t, 33, -1, rto)
+	if !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatal("dial:", err)
+	}
+
+	sent := link.sent()
+	if len(sent) != 1+maxSYNRetries {
+		t.Fatal(len(sent), "SYNs sent, want", 1+maxSYNRetries)
+	}
+	want := rto
+	for i := 1; i < len(sent); i++ {
+		if interval := sent[i].Sub(sent[i-1]); interval < want || interval > want+want/2+20*time.Millisecond {
+			t.Errorf("SYN %d sent %v after the previous one, want %v", i, interval, want)
+		}
+		want *= 2
+	}
+}
+
+func TestICMPUnreachableErrors(t *testing.T) {
+	for _, c := range []struct {
+		code uint8
+		err  syscall.Errno
+		soft bool
+	}{
+		{ICMPCodeNetUnreachable, syscall.ENETUNREACH, true},
+		{ICMPCodeHostUnreachable, syscall.EHOSTUNREACH, true},
+		{ICMPCodeProtocolUnreachable, syscall.ENOPROTOOPT, false},
+		{ICMPCodePortUnreachable, syscall.ECONNREFUSED, false},
+		{ICMPCodeFragmentationNeeded, syscall.EMSGSIZE, false},
+		{ICMPCodeSourceRouteFailed, syscall.EHOSTUNREACH, true},
+	} {
+		err := &ICMPUnreachableError{Code: c.code}
+		if !errors.Is(err, c.err) || err.Soft() != c.soft {
+			t.Errorf("code %d: %v, soft %v, want %v, soft %v", c.code, errors.Unwrap(err), err.Soft(), c.err, c.soft)
+		}
+	}
+}
+
+// A port unreachable fails the dial at once, a host unreachable only once
+// the handshake times out
+func TestDialICMPUnreachable(t *testing.T) {
+	link, err := dialDropping(t, 133, ICMPCodePortUnreachable, 20*time.Millisecond)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatal("dial with port unreachable:", err)
+	}
+	if sent := len(link.sent()); sent != 1 {
+		t.Fatal(sent, "SYNs sent after a port unreachable")
+	}
+
+	link, err = dialDropping(t, 233, ICMPCodeHostUnreachable, 5*time.Millisecond)
+	if !errors.Is(err, syscall.EHOSTUNREACH) {
+		t.Fatal("dial with host unreachable:", err)
+	}
+	if sent := len(link.sent()); sent != 1+maxSYNRetries {
+		t.Fatal(sent, "SYNs sent with host unreachable, want", 1+maxSYNRetries)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	pawsIdleLimit               = 24 * 24 * time.Hour //TS.Recent is invalid after 24 days (RFC 7323 5.5)
+	maxSACKBlocksWithTimestamps = 3                   //Timestamps take 10 of the 40 bytes of options
+)
+
+// Timestamps option (RFC 7323): TSval then TSecr
+func encodeTimestamps(val, ecr uint32) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, val)
+	binary.BigEndian.PutUint32(data[4:], ecr)
+	return data
+}
+
+func decodeTimestamps(option *TCPOption) (val, ecr uint32, ok bool) {
+	if option == nil || len(option.Data) < 8 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(option.Data), binary.BigEndian.Uint32(option.Data[4:]), true
+}
+
+// Starts the timestamp clock with a random offset, before the SYN is sent
+func (t *TeaCPConn) initTimestamps() {
+	t.tsStart = time.Now()
+	t.tsOffset = rand.Uint32()
+}
+
+// Timestamp clock, one tick per millisecond
+func (t *TeaCPConn) tsVal() uint32 {
+	return t.tsOffset + uint32(time.Since(t.tsStart)/time.Millisecond)
+}
+
+// Timestamps of the SYN or SYN+ACK of the peer, the option is used only if
+// both sides sent it
+func (t *TeaCPConn) negotiateTimestamps(syn *TCPPacket) {
+	val, _, ok := decodeTimestamps(syn.Option(OptionTimestamps))
+	t.tsEnabled = ok
+	if ok {
+		t.tsRecent = val
+		t.tsRecentAge = time.Now()
+	}
+}
+
+// Must be called with sendCond.L held
+func (t *TeaCPConn) addTimestamps(packet *TCPPacket) {
+	if t.tsEnabled {
+		packet.AddOption(OptionTimestamps, encodeTimestamps(t.tsVal(), t.tsRecent))
+	}
+}
+
+// PAWS check and TS.Recent update (RFC 7323 5.3). Returns false for an old
+// duplicate that must be dropped, an ACK is then sent.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) checkTimestamps(packet *TCPPacket) bool {
+	if !t.tsEnabled {
+		return true
+	}
+	val, _, ok := decodeTimestamps(packet.Option(OptionTimestamps))
+	if !ok {
+		return true
+	}
+
+	if seqLT(val, t.tsRecent) && time.Since(t.tsRecentAge) < pawsIdleLimit {
+		fmt.Println("I: PAWS, old duplicate dropped", val, "<", t.tsRecent)
+		t.ackNow = true
+		return false
+	}
+	if seqLEQ(packet.SeqNum, t.lastSentAck) {
+		t.tsRecent = val
+		t.tsRecentAge = time.Now()
+	}
+	return true
+}
+
+// RTT sample from the timestamp echoed by an ACK of new data (RFC 7323 4.2)
+// Must be called with sendCond.L held
+func (t *TeaCPConn) timestampRTT(packet *TCPPacket) (time.Duration, bool) {
+	if !t.tsEnabled {
+		return 0, false
+	}
+	_, ecr, ok := decodeTimestamps(packet.Option(OptionTimestamps))
+	if !ok || ecr == 0 {
+		return 0, false
+	}
+	elapsed := int32(t.tsVal() - ecr)
+	if elapsed < 0 {
+		return 0, false
+	}
+	return time.Duration(elapsed) * time.Millisecond, true
+}
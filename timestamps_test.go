@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func timestampedSegment(seq, val, ecr uint32) *TCPPacket {
+	p := &TCPPacket{SeqNum: seq, DataOffset: 5, WindowSize: 65535}
+	p.SetFlag(FlagACK)
+	p.AddOption(OptionTimestamps, encodeTimestamps(val, ecr))
+	return p
+}
+
+func TestPAWS(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		recent   uint32
+		idle     time.Duration
+		seq, val uint32
+		accepted bool
+		updated  bool
+	}{
+		{"newer", 5000, 0, 1000, 6000, true, true},
+		{"same", 5000, 0, 1000, 5000, true, true},
+		{"old duplicate", 5000, 0, 1000, 4000, false, false},
+		{"old after 24 days idle", 5000, pawsIdleLimit + time.Hour, 1000, 4000, true, true},
+		{"old before 24 days idle", 5000, pawsIdleLimit - time.Hour, 1000, 4000, false, false},
+		{"wrapped", 0xfffffff0, 0, 1000, 0x10, true, true},
+		{"older across the wrap", 0x10, 0, 1000, 0xfffffff0, false, false},
+		{"above the last ACK sent", 5000, 0, 2000, 6000, true, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn := &TeaCPConn{tsEnabled: true, tsRecent: c.recent, tsRecentAge: time.Now().Add(-c.idle), lastSentAck: 1000}
+			if accepted := conn.checkTimestamps(timestampedSegment(c.seq, c.val, 0)); accepted != c.accepted {
+				t.Fatal("accepted", accepted)
+			}
+			if conn.ackNow == c.accepted {
+				t.Error("ACK sent", conn.ackNow)
+			}
+			if updated := conn.tsRecent == c.val; updated != c.updated {
+				t.Error("TS.Recent", conn.tsRecent)
+			}
+		})
+	}
+
+	//Without the option or when not negotiated
+	conn := &TeaCPConn{tsEnabled: true, tsRecent: 5000, tsRecentAge: time.Now()}
+	if !conn.checkTimestamps(&TCPPacket{}) {
+		t.Error("segment without timestamps dropped")
+	}
+	conn.tsEnabled = false
+	if !conn.checkTimestamps(timestampedSegment(0, 4000, 0)) {
+		t.Error("PAWS without the option negotiated")
+	}
+}
+
+func TestTimestampRTT(t *testing.T) {
+	conn := &TeaCPConn{tsEnabled: true, tsStart: time.Now().Add(-time.Second), tsOffset: 0xfffffe00}
+	now := conn.tsVal()
+
+	for _, c := range []struct {
+		name    string
+		packet  *TCPPacket
+		sampled bool
+	}{
+		{"valid echo", timestampedSegment(0, 1, now-40), true},
+		{"echo across the wrap", timestampedSegment(0, 1, conn.tsOffset+10), true},
+		{"no echo", timestampedSegment(0, 1, 0), false},
+		{"echo from the future", timestampedSegment(0, 1, now+1000), false},
+		{"no option", &TCPPacket{}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			rtt, sampled := conn.timestampRTT(c.packet)
+			if sampled != c.sampled {
+				t.Fatal("sampled", sampled, rtt)
+			}
+			_, ecr, _ := decodeTimestamps(c.packet.Option(OptionTimestamps))
+			if sampled && (rtt < time.Duration(now-ecr)*time.Millisecond || rtt > time.Duration(now-ecr)*time.Millisecond+100*time.Millisecond) {
+				t.Error("RTT", rtt, "echo", now-ecr, "ms ago")
+			}
+		})
+	}
+
+	conn.tsEnabled = false
+	if _, sampled := conn.timestampRTT(timestampedSegment(0, 1, now-40)); sampled {
+		t.Error("sample without the option negotiated")
+	}
+}
+
+// Only the ACKs of new data give a sample
+func TestTimestampRTTSampledOnNewData(t *testing.T) {
+	conn := recoveringConn(t)
+	conn.tsEnabled = true
+	conn.tsStart = time.Now().Add(-time.Second)
+	conn.sendCond.L.Lock()
+	defer conn.sendCond.L.Unlock()
+
+	dup := timestampedSegment(0, 1, conn.tsVal()-500)
+	dup.AckNum = 1000
+	conn.processAck(dup)
+	if conn.rtt.srtt != 0 {
+		t.Fatal("sample from a duplicate ACK", conn.rtt.srtt)
+	}
+
+	noEcho := timestampedSegment(0, 1, 0)
+	noEcho.AckNum = 2000
+	conn.processAck(noEcho)
+	if conn.rtt.srtt != 0 {
+		t.Fatal("sample without echo", conn.rtt.srtt)
+	}
+
+	ack := timestampedSegment(0, 1, conn.tsVal()-40)
+	ack.AckNum = 3000
+	conn.processAck(ack)
+	if conn.rtt.srtt < 40*time.Millisecond || conn.rtt.srtt > 140*time.Millisecond {
+		t.Fatal("smoothed RTT", conn.rtt.srtt, "after a 40ms sample")
+	}
+}
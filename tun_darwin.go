@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+)
+
+// TUN device of the tuntap kernel extension, without virtio net headers.
+// os.OpenFile registers the character device with the runtime poller. The
+// device has a single queue and can only be opened once.
+func openTunDevice(name string, multiQueue bool) (*os.File, bool, error) {
+	file, err := os.OpenFile("/dev/"+name, os.O_RDWR, os.ModeCharDevice)
+	return file, false, err
+}
+
+func openTunRawDevice(name string) (*os.File, error) {
+	return os.OpenFile("/dev/"+name, os.O_RDWR, os.ModeCharDevice)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	iffVnetHdr    = 0x4000
+	iffMultiQueue = 0x0100
+	tunSetOffload = 0x400454d0
+	tunFCsum      = 0x01
+	tunFTSO4      = 0x02
+)
+
+// Opens the TUN interface name with virtio net headers, so that TCP
+// segments are coalesced in both directions (TSO/GSO and GRO). Returns false
+// if the offloads are not supported, the device is then used without
+// headers. Without multiQueue the open is exclusive: it fails with EBUSY if
+// the device is already attached. With it, the fd is one more queue of the
+// device, the kernel spreads the flows over all of them.
+func openTunDevice(name string, multiQueue bool) (*os.File, bool, error) {
+	flags := uint16(syscall.IFF_TUN | syscall.IFF_NO_PI)
+	if multiQueue {
+		flags |= iffMultiQueue
+	}
+	fd, err := openTunFd(name, flags|iffVnetHdr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	vnetHdr := true
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetOffload, tunFCsum|tunFTSO4)
+	if errno != 0 {
+		//No offload: reopen without the header
+		syscall.Close(fd)
+		vnetHdr = false
+		fd, err = openTunFd(name, flags)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return newPollableFile(fd, "/dev/net/tun"), vnetHdr, nil
+}
+
+// Opens the TUN interface name exclusively, without any offload: the
+// packets read are never larger than the MTU of the interface
+func openTunRawDevice(name string) (*os.File, error) {
+	fd, err := openTunFd(name, syscall.IFF_TUN|syscall.IFF_NO_PI)
+	if err != nil {
+		return nil, err
+	}
+	return newPollableFile(fd, "/dev/net/tun"), nil
+}
+
+// Attaches a new fd of /dev/net/tun to the interface name
+func openTunFd(name string, flags uint16) (int, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, os.NewSyscallError("open /dev/net/tun", err)
+	}
+
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], name)
+	req.flags = flags
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("ioctl TUNSETIFF", errno)
+	}
+	return fd, nil
+}
+
+// The fd is set non-blocking first so that os.NewFile registers it with the
+// runtime poller: reads park the goroutine instead of a thread and support
+// deadlines. Fd() must not be called on the file, it would make it blocking.
+func newPollableFile(fd int, name string) *os.File {
+	syscall.SetNonblock(fd, true)
+	return os.NewFile(uintptr(fd), name)
+}
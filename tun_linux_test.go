@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+const benchSegments = 44 //44 segments of 1460 bytes fit in one GSO packet
+
+var (
+	benchLocal  = &net.IPAddr{IP: net.IPv4(10, 12, 0, 1)}
+	benchRemote = &net.IPAddr{IP: net.IPv4(10, 12, 0, 2)}
+)
+
+// TunIPConn whose single queue is one end of a SOCK_SEQPACKET socket pair,
+// which keeps the packet boundaries like a TUN fd. The other end is
+// returned, it reads EOF once the queue is closed and drained.
+func socketTunIPConn(tb testing.TB, vnetHdr bool) (*TunIPConn, *os.File) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		tb.Skip("socketpair:", err)
+	}
+	for _, fd := range fds {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4<<20)
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4<<20)
+	}
+
+	conn := NewTunIPConn(benchLocal, benchRemote)
+	conn.vnetHdr = vnetHdr
+	conn.queues = []*tunQueue{{
+		file:       newPollableFile(fds[0], "bench"),
+		readBuffer: make([]byte, 65536+virtioNetHdrLen)}}
+	return conn, os.NewFile(uintptr(fds[1]), "peer")
+}
+
+// The packets are logged as they are serialized, which would dominate
+func quiet(b *testing.B) {
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	os.Stdout = devNull
+	b.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
+
+// Consecutive full segments of a bulk transfer
+func benchSegmentsOf(count int) []Segment {
+	segments := make([]Segment, count)
+	for i := range segments {
+		packet := &TCPPacket{SrcPort: 40000, DestPort: 80, SeqNum: uint32(1000 + i*1460), AckNum: 1, WindowSize: 65535, Data: make([]byte, 1460)}
+		packet.SetFlag(FlagACK)
+		segments[i].Data = packet.Marshall(benchLocal.IP.String(), benchRemote.IP.String())
+	}
+	return segments
+}
+
+func benchmarkTunWrite(b *testing.B, vnetHdr, batch bool) {
+	quiet(b)
+	conn, peer := socketTunIPConn(b, vnetHdr)
+	defer conn.Close()
+
+	var writes int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 65536+virtioNetHdrLen)
+		for {
+			if n, err := peer.Read(buffer); err != nil || n == 0 {
+				return
+			}
+			atomic.AddInt64(&writes, 1)
+		}
+	}()
+
+	segments := benchSegmentsOf(benchSegments)
+	b.SetBytes(int64(benchSegments * 1460))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batch {
+			if _, err := conn.WriteBatch(segments); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, segment := range segments {
+			if _, err := conn.WriteECN(segment.Data, segment.ECN); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+
+	conn.Close()
+	<-done
+	peer.Close()
+	b.ReportMetric(float64(atomic.LoadInt64(&writes))/float64(b.N*benchSegments), "writes/segment")
+}
+
+// One write(2) per segment
+func BenchmarkTunWrite(b *testing.B) {
+	for _, vnetHdr := range []bool{false, true} {
+		b.Run(fmt.Sprint("vnet=", vnetHdr), func(b *testing.B) { benchmarkTunWrite(b, vnetHdr, false) })
+	}
+}
+
+// Coalesced into GSO packets with virtio net headers, one write(2) per
+// segment otherwise
+func BenchmarkTunWriteBatch(b *testing.B) {
+	for _, vnetHdr := range []bool{false, true} {
+		b.Run(fmt.Sprint("vnet=", vnetHdr), func(b *testing.B) { benchmarkTunWrite(b, vnetHdr, true) })
+	}
+}
+
+func benchmarkTunRead(b *testing.B, vnetHdr, batch bool) {
+	quiet(b)
+	conn, peer := socketTunIPConn(b, vnetHdr)
+	defer conn.Close()
+	defer peer.Close()
+
+	//IP packets as the kernel queues them on the device
+	var packets [][]byte
+	for _, segment := range benchSegmentsOf(readBatchSegments) {
+		packet := newTCPIPV4Packet(IPV4AddrToInt(benchRemote.IP.String()), IPV4AddrToInt(benchLocal.IP.String()), ECNNotECT, segment.Data).Serialize()
+		if vnetHdr {
+			packet = append(make([]byte, virtioNetHdrLen), packet...)
+		}
+		packets = append(packets, packet)
+	}
+
+	segments := make([]Segment, readBatchSegments)
+	for i := range segments {
+		segments[i].Data = make([]byte, 65535)
+	}
+	b.SetBytes(int64(readBatchSegments * 1460))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, packet := range packets {
+			if _, err := peer.Write(packet); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		for read := 0; read < len(packets); {
+			if batch {
+				n, err := conn.ReadBatch(segments)
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += n
+				continue
+			}
+			if _, _, err := conn.ReadECN(segments[0].Data[:cap(segments[0].Data)]); err != nil {
+				b.Fatal(err)
+			}
+			read++
+		}
+	}
+}
+
+// One read per segment, each through the runtime poller
+func BenchmarkTunRead(b *testing.B) {
+	for _, vnetHdr := range []bool{false, true} {
+		b.Run(fmt.Sprint("vnet=", vnetHdr), func(b *testing.B) { benchmarkTunRead(b, vnetHdr, false) })
+	}
+}
+
+// The queued segments are drained without going back to the poller, still
+// one read(2) each as they are not coalesced
+func BenchmarkTunReadBatch(b *testing.B) {
+	for _, vnetHdr := range []bool{false, true} {
+		b.Run(fmt.Sprint("vnet=", vnetHdr), func(b *testing.B) { benchmarkTunRead(b, vnetHdr, true) })
+	}
+}
+
+// The device of a router and the queues of the stack exclude each other
+func TestTunPacketDeviceExclusive(t *testing.T) {
+	stack := NewTunIPConn(benchLocal, nil)
+	stack.name = "teacp48"
+	if err := stack.OpenQueues(2); err != nil {
+		t.Skip("no TUN device:", err)
+	}
+	if device, err := TunPacketDevice("teacp48")(); err == nil {
+		device.Close()
+		t.Fatal("router device opened on the queues of the stack")
+	}
+	stack.Close()
+
+	device, err := TunPacketDevice("teacp48")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	for _, queues := range []int{1, 2} {
+		stack := NewTunIPConn(benchLocal, nil)
+		stack.name = "teacp48"
+		if err := stack.OpenQueues(queues); err == nil {
+			stack.Close()
+			t.Fatal(queues, "queues opened on the device of the router")
+		}
+	}
+}
+
+// A packet coalesced by the kernel is split back into the segments it was
+// made of by a single read
+func TestTunReadBatchSplitsGSO(t *testing.T) {
+	conn, peer := socketTunIPConn(t, true)
+	defer conn.Close()
+	defer peer.Close()
+
+	//Bulk transfer from the remote end, the last segment pushed
+	var sent []Segment
+	for i := 0; i < 5; i++ {
+		packet := &TCPPacket{SrcPort: 80, DestPort: 40000, SeqNum: uint32(1000 + i*1460), AckNum: 1, WindowSize: 65535, Data: make([]byte, 1460)}
+		for j := range packet.Data {
+			packet.Data[j] = byte(i)
+		}
+		packet.SetFlag(FlagACK)
+		if i == 4 {
+			packet.SetFlag(FlagPSH)
+		}
+		sent = append(sent, Segment{Data: packet.Marshall(benchRemote.IP.String(), benchLocal.IP.String())})
+	}
+	remote, local := IPV4AddrToInt(benchRemote.IP.String()), IPV4AddrToInt(benchLocal.IP.String())
+	coalesced, count := coalesceSegments(sent, remote, local)
+	if count != len(sent) {
+		t.Fatal(count, "segments coalesced")
+	}
+	single := append(make([]byte, virtioNetHdrLen), newTCPIPV4Packet(remote, local, ECNNotECT, sent[0].Data).Serialize()...)
+
+	//Checksums aside, the segments read are the ones sent
+	same := func(a, b []byte) bool {
+		return len(a) == len(b) && bytes.Equal(a[:16], b[:16]) && bytes.Equal(a[18:], b[18:])
+	}
+	segments := make([]Segment, readBatchSegments)
+	for i := range segments {
+		segments[i].Data = make([]byte, 65535)
+	}
+	write := func(packets ...[]byte) {
+		for _, packet := range packets {
+			if _, err := peer.Write(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write(coalesced, single)
+	n, err := conn.ReadBatch(segments)
+	if err != nil || n != len(sent)+1 {
+		t.Fatal("read", n, "segments,", err)
+	}
+	for i, segment := range append(sent, sent[0]) {
+		if !same(segments[i].Data, segment.Data) {
+			t.Errorf("segment %d: %v, want %v", i, NewTCPPacket(segments[i].Data), NewTCPPacket(segment.Data))
+		}
+	}
+
+	//Fewer slots than segments: the last one gets the remaining payload
+	write(coalesced, single)
+	n, err = conn.ReadBatch(segments[:3])
+	if err != nil || n != 3 {
+		t.Fatal("read", n, "segments,", err)
+	}
+	last := NewTCPPacket(segments[2].Data)
+	if !same(segments[1].Data, sent[1].Data) || last.SeqNum != NewTCPPacket(sent[2].Data).SeqNum ||
+		len(last.Data) != 3*1460 || !last.HasFlag(FlagPSH) {
+		t.Fatal("last segment", last)
+	}
+	n, err = conn.ReadBatch(segments)
+	if err != nil || n != 1 || !same(segments[0].Data, sent[0].Data) {
+		t.Fatal("read", n, "segments,", err, "after the split packet")
+	}
+}
+
+// A device is attached to a single connection or listener
+func TestTunInUse(t *testing.T) {
+	open := func(n int) (*TunIPConn, error) {
+		conn := NewTunIPConn(benchLocal, nil)
+		conn.name = "teacp45"
+		return conn, conn.OpenQueues(n)
+	}
+	inUse := func(err error) bool {
+		var tunErr *TunInUseError
+		return errors.As(err, &tunErr) && tunErr.Name == "teacp45" && errors.Is(err, syscall.EBUSY)
+	}
+
+	for _, queues := range []int{1, 2} {
+		owner, err := open(queues)
+		if err != nil {
+			t.Skip("TUN device:", err)
+		}
+		for _, n := range []int{1, 2} {
+			if _, err := open(n); !inUse(err) {
+				t.Errorf("open of %d queues while %d are attached: %v", n, queues, err)
+			}
+		}
+		if _, err := TunPacketDevice("teacp45")(); !inUse(err) {
+			t.Errorf("forwarding while %d queues are attached: %v", queues, err)
+		}
+		owner.Close()
+	}
+
+	//Attached by another process, the kernel refuses the open
+	file, err := openTunRawDevice("teacp45")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(1); !inUse(err) {
+		t.Error("open while attached outside the process:", err)
+	}
+	file.Close()
+
+	//Released by Close
+	conn, err := open(1)
+	if err != nil {
+		t.Fatal("open after close:", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Urgent data (RFC 793, RFC 6093). The urgent pointer points to the byte
+// following the urgent data, only its last byte is delivered out of band.
+
+// Writes b and marks its last byte as urgent
+func (t *TeaCPConn) WriteOOB(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	t.sendCond.L.Lock()
+	if t.err != nil {
+		err := t.err
+		t.sendCond.L.Unlock()
+		return 0, t.opError("write", err)
+	}
+	t.sendBuffer = append(t.sendBuffer, b...)
+	t.sndUrgentPointer = t.localSeqNumber + uint32(len(t.sendBuffer))
+	t.sndUrgentPending = true
+	t.sendCond.Signal()
+	t.sendCond.L.Unlock()
+
+	return len(b), nil
+}
+
+// Sets URG and the urgent pointer on a segment sent before the urgent data
+// was acknowledged. Must be called with sendCond.L held
+func (t *TeaCPConn) markUrgent(packet *TCPPacket) {
+	if !t.sndUrgentPending || !seqLT(packet.SeqNum, t.sndUrgentPointer) {
+		return
+	}
+
+	offset := t.sndUrgentPointer - packet.SeqNum
+	if offset > 0xffff {
+		offset = 0xffff //The pointer is beyond this segment, it only signals urgent mode
+	}
+	packet.SetFlag(FlagURG)
+	packet.Urgent = uint16(offset)
+}
+
+// Urgent pointer of a received segment. Must be called with sendCond.L held
+func (t *TeaCPConn) receivedUrgent(packet *TCPPacket) {
+	if !packet.HasFlag(FlagURG) || packet.Urgent == 0 {
+		return
+	}
+
+	pointer := packet.SeqNum + uint32(packet.Urgent)
+	if seqLEQ(pointer, t.remoteSeqNumber) {
+		return //Urgent data already delivered
+	}
+	if !t.rcvUrgentPending || seqGT(pointer, t.rcvUrgentPointer) {
+		fmt.Println("I: urgent data up to", pointer)
+		t.rcvUrgentPointer = pointer
+		t.rcvUrgentPending = true
+	}
+}
+
+// Appends in order data starting at seq to the receive buffer, extracting the
+// urgent byte when it is not read inline. Must be called with rcvBufferCon.L held
+func (t *TeaCPConn) bufferData(data []byte, seq uint32, urgentSeq uint32, urgent bool) {
+	if urgent && seqGEQ(urgentSeq, seq) && seqLT(urgentSeq, seq+uint32(len(data))) {
+		i := int(urgentSeq - seq)
+		t.rcvMark = t.rcvBuffer.Len() + i
+		if !t.oobInline {
+			t.oobByte = data[i]
+			t.oobValid = true
+			t.rcvBuffer.Write(data[:i])
+			data = data[i+1:]
+		}
+	}
+	t.rcvBuffer.Write(data)
+}
+
+// Reads the urgent byte received out of band. Fails with EINVAL if there is
+// none or if it is read inline, EWOULDBLOCK if it was announced but not received yet.
+func (t *TeaCPConn) ReadOOB(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	t.sendCond.L.Lock()
+	announced := t.rcvUrgentPending
+	t.sendCond.L.Unlock()
+
+	t.rcvBufferCon.L.Lock()
+	defer t.rcvBufferCon.L.Unlock()
+
+	if t.oobInline {
+		return 0, t.opError("read", syscall.EINVAL)
+	}
+	if t.oobValid {
+		b[0] = t.oobByte
+		t.oobValid = false
+		return 1, nil
+	}
+	if announced {
+		return 0, t.opError("read", syscall.EWOULDBLOCK)
+	}
+	if t.rcvErr != nil {
+		return 0, t.opError("read", t.rcvErr)
+	}
+	return 0, t.opError("read", syscall.EINVAL)
+}
+
+// With inline, the urgent byte stays in the normal data stream (SO_OOBINLINE)
+func (t *TeaCPConn) SetOOBInline(inline bool) error {
+	t.rcvBufferCon.L.Lock()
+	t.oobInline = inline
+	t.rcvBufferCon.L.Unlock()
+	return nil
+}
+
+// Reports whether the next byte read is at the urgent mark (SIOCATMARK)
+func (t *TeaCPConn) AtMark() bool {
+	t.rcvBufferCon.L.Lock()
+	defer t.rcvBufferCon.L.Unlock()
+	return t.rcvMark == 0
+}
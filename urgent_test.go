@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func readString(t *testing.T, conn *TeaCPConn, want string) {
+	b := make([]byte, 100)
+	n, err := conn.Read(b)
+	if err != nil || string(b[:n]) != want {
+		t.Fatalf("read %q, %v, want %q", b[:n], err, want)
+	}
+}
+
+func readOOB(t *testing.T, conn *TeaCPConn, want error) byte {
+	b := make([]byte, 1)
+	n, err := conn.ReadOOB(b)
+	if !errors.Is(err, want) && !(want == nil && err == nil) {
+		t.Fatal("ReadOOB:", err, "want", want)
+	}
+	if err == nil && n != 1 {
+		t.Fatal("ReadOOB read", n, "bytes")
+	}
+	return b[0]
+}
+
+func TestUrgentOutOfBand(t *testing.T) {
+	client, server := loopbackPair(t, 37, 7037)
+
+	if _, err := client.WriteOOB([]byte("abc!")); err != nil {
+		t.Fatal(err)
+	}
+	readString(t, server, "abc")
+	if !server.AtMark() {
+		t.Fatal("not at the mark after the data before it")
+	}
+	if b := readOOB(t, server, nil); b != '!' {
+		t.Fatalf("urgent byte %q", b)
+	}
+	readOOB(t, server, syscall.EINVAL)
+
+	exchange(t, client, server, "next")
+	if server.AtMark() {
+		t.Fatal("still at the mark")
+	}
+}
+
+func TestUrgentInline(t *testing.T) {
+	client, server := loopbackPair(t, 137, 7137)
+	server.SetOOBInline(true)
+
+	if _, err := client.WriteOOB([]byte("xyz#")); err != nil {
+		t.Fatal(err)
+	}
+	readString(t, server, "xyz")
+	if !server.AtMark() {
+		t.Fatal("not at the mark after the data before it")
+	}
+	readOOB(t, server, syscall.EINVAL)
+	readString(t, server, "#")
+	if server.AtMark() {
+		t.Fatal("still at the mark")
+	}
+}
+
+// A later segment moves the urgent pointer forward before the urgent byte
+// arrives, only the last one is urgent (RFC 6093)
+func TestUrgentPointerMovesForward(t *testing.T) {
+	serverAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	clientAddr := &net.IPAddr{IP: net.IPv4(127, 0, 0, 237)}
+	listener, err := ListenLink(OpenLoopback, serverAddr, 7237)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client := rawLoopbackClient(t, clientAddr, serverAddr, 40037, 7237)
+	send := func(p *TCPPacket) {
+		p.SrcPort, p.DestPort, p.DataOffset, p.WindowSize = 40037, 7237, 5, 65535
+		if _, err := client.Write(p.Marshall(clientAddr.IP.String(), serverAddr.IP.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syn := &TCPPacket{SeqNum: 1000}
+	syn.SetFlag(FlagSYN)
+	send(syn)
+	synAck := readSegment(t, client)
+	if !synAck.HasFlag(FlagSYN) || !synAck.HasFlag(FlagACK) {
+		t.Fatal("no SYN+ACK:", synAck)
+	}
+	ack := &TCPPacket{SeqNum: 1001, AckNum: synAck.SeqNum + 1}
+	ack.SetFlag(FlagACK)
+	send(ack)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	server, err := listener.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Abort()
+
+	urgent := func(seq uint32, data string, pointer uint16) {
+		p := &TCPPacket{SeqNum: seq, AckNum: synAck.SeqNum + 1, Urgent: pointer, Data: []byte(data)}
+		p.SetFlag(FlagACK)
+		p.SetFlag(FlagURG)
+		send(p)
+	}
+
+	//Urgent byte at 1006, beyond the segment
+	urgent(1001, "ab", 6)
+	readString(t, server, "ab")
+	readOOB(t, server, syscall.EWOULDBLOCK)
+
+	//Moved forward to 1008
+	urgent(1003, "cd", 6)
+	readString(t, server, "cd")
+	readOOB(t, server, syscall.EWOULDBLOCK)
+	if server.AtMark() {
+		t.Fatal("at the mark before the urgent data")
+	}
+
+	urgent(1005, "efgh", 4)
+	readString(t, server, "efg")
+	if !server.AtMark() {
+		t.Fatal("not at the mark")
+	}
+	if b := readOOB(t, server, nil); b != 'h' {
+		t.Fatalf("urgent byte %q, want 'h'", b)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+const (
+	minUserTimeout        = 100 * time.Second //L_LIMIT for values advertised by the peer
+	maxUserTimeout        = time.Duration(0x7fff) * time.Minute
+	utoGranularityMinutes = 0x8000 //G bit: the value is in minutes
+)
+
+// Encodes a User Timeout option (RFC 5482)
+func encodeUserTimeout(d time.Duration) []byte {
+	value := uint16(d / time.Second)
+	if d >= 0x8000*time.Second {
+		value = uint16(d/time.Minute) | utoGranularityMinutes
+	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return data
+}
+
+func decodeUserTimeout(data []byte) time.Duration {
+	if len(data) < 2 {
+		return 0
+	}
+	value := binary.BigEndian.Uint16(data)
+	if value&utoGranularityMinutes != 0 {
+		return time.Duration(value&0x7fff) * time.Minute
+	}
+	return time.Duration(value) * time.Second
+}
+
+// Aborts the connection when transmitted data stays unacknowledged longer
+// than timeout. 0 clears the local value: the one advertised by the peer is
+// used again, if any. With advertise, the value is sent to the peer in the
+// User Timeout option of the next segment.
+func (t *TeaCPConn) SetUserTimeout(timeout time.Duration, advertise bool) error {
+	if timeout < 0 || timeout > maxUserTimeout {
+		return fmt.Errorf("Invalid user timeout %v", timeout)
+	}
+
+	t.sendCond.L.Lock()
+	defer t.sendCond.L.Unlock()
+
+	t.userTimeout = timeout
+	t.userTimeoutLocal = timeout > 0
+	if !t.userTimeoutLocal {
+		t.userTimeout = t.peerUserTimeout
+	}
+	t.advertiseUserTimeout = advertise && timeout > 0
+	t.armUserTimeout()
+	return nil
+}
+
+// User Timeout option received. The advertised value is used, within
+// limits, unless one was set locally (RFC 5482 section 3).
+// Must be called with sendCond.L held
+func (t *TeaCPConn) receivedUserTimeout(option *TCPOption) {
+	timeout := decodeUserTimeout(option.Data)
+	if timeout < minUserTimeout {
+		timeout = minUserTimeout
+	}
+	t.peerUserTimeout = timeout
+	if t.userTimeoutLocal {
+		return
+	}
+	if timeout != t.userTimeout {
+		fmt.Println("I: user timeout advertised by the peer", timeout)
+		t.userTimeout = timeout
+		t.armUserTimeout()
+	}
+}
+
+// (Re)starts the user timeout from the oldest unacknowledged data.
+// Must be called with sendCond.L held
+func (t *TeaCPConn) armUserTimeout() {
+	if t.userTimeoutTimer != nil {
+		t.userTimeoutTimer.Stop()
+		t.userTimeoutTimer = nil
+	}
+	if t.userTimeout == 0 || len(t.ackWaitingBuffer) == 0 || t.err != nil {
+		return
+	}
+
+	delay := t.userTimeout - time.Since(t.unackedSince)
+	if delay < 0 {
+		delay = 0
+	}
+	t.userTimeoutTimer = time.AfterFunc(delay, t.onUserTimeout)
+}
+
+func (t *TeaCPConn) onUserTimeout() {
+	t.sendCond.L.Lock()
+	t.userTimeoutTimer = nil
+	expired := t.userTimeout > 0 && len(t.ackWaitingBuffer) > 0 && time.Since(t.unackedSince) >= t.userTimeout
+	if !expired {
+		t.armUserTimeout()
+	}
+	t.sendCond.L.Unlock()
+
+	if expired {
+		fmt.Println("O: data unacknowledged for more than the user timeout", t.userTimeout)
+		t.abort(syscall.ETIMEDOUT)
+	}
+}
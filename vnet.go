@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Header preceding the packets of a TUN device opened with IFF_VNET_HDR
+// (struct virtio_net_hdr), in host byte order
+const (
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+	virtioNetHdrGSONone    = 0
+	virtioNetHdrGSOTCPv4   = 1
+	virtioNetHdrGSOECN     = 0x80
+)
+
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+const (
+	tcpFlagsOffset = 13
+	tcpFlagFIN     = 1 << FlagFIN
+	tcpFlagPSH     = 1 << FlagPSH
+	tcpFlagACK     = 1 << FlagACK
+	tcpFlagCWR     = 1 << FlagCWR
+)
+
+// Coalesces the leading segments that the kernel can split back into the
+// same segments: contiguous sequence numbers, same header apart from the
+// sequence number, checksum and PSH, and gsoSize bytes of payload except
+// for the last one. Returns the packet with its virtio net header and the
+// number of segments it holds.
+func coalesceSegments(segments []Segment, src, dst uint32) ([]byte, int) {
+	first := segments[0].Data
+	headerLen := tcpHeaderLen(first)
+	gsoSize := len(first) - headerLen
+	flags := first[tcpFlagsOffset]
+
+	count := 1
+	if headerLen > 0 && gsoSize > 0 && flags&^(tcpFlagACK|tcpFlagCWR) == 0 {
+		seq := binary.BigEndian.Uint32(first[4:]) + uint32(gsoSize)
+		total := 20 + len(first)
+		for count < len(segments) {
+			next := segments[count].Data
+			payload := len(next) - headerLen
+			if segments[count].ECN != segments[0].ECN || tcpHeaderLen(next) != headerLen ||
+				payload <= 0 || payload > gsoSize || total+payload > 65535 ||
+				binary.BigEndian.Uint32(next[4:]) != seq || next[tcpFlagsOffset]&^tcpFlagPSH != tcpFlagACK ||
+				!sameTCPHeader(first, next, headerLen) {
+				break
+			}
+			count++
+			seq += uint32(payload)
+			total += payload
+			if payload < gsoSize || next[tcpFlagsOffset]&tcpFlagPSH != 0 {
+				break //Only the last segment can be shorter or pushed
+			}
+		}
+	}
+
+	hdr := virtioNetHdr{}
+	tcp := first
+	if count > 1 {
+		tcp = make([]byte, headerLen, headerLen+count*gsoSize)
+		copy(tcp, first[:headerLen])
+		for _, segment := range segments[:count] {
+			tcp = append(tcp, segment.Data[headerLen:]...)
+		}
+		tcp[tcpFlagsOffset] |= segments[count-1].Data[tcpFlagsOffset] & tcpFlagPSH
+
+		//Partial checksum: the pseudo header only, completed per segment
+		binary.BigEndian.PutUint16(tcp[16:], pseudoHeaderSum(src, dst, len(tcp)))
+		hdr = virtioNetHdr{
+			flags:      virtioNetHdrFNeedsCsum,
+			gsoType:    virtioNetHdrGSOTCPv4,
+			hdrLen:     uint16(20 + headerLen),
+			gsoSize:    uint16(gsoSize),
+			csumStart:  20,
+			csumOffset: 16}
+		if flags&tcpFlagCWR != 0 {
+			hdr.gsoType |= virtioNetHdrGSOECN
+		}
+	}
+
+	ip := newTCPIPV4Packet(src, dst, segments[0].ECN, tcp).Serialize()
+	packet := make([]byte, virtioNetHdrLen+len(ip))
+	hdr.encode(packet)
+	copy(packet[virtioNetHdrLen:], ip)
+	return packet, count
+}
+
+// Splits a TCP segment coalesced by the kernel into the segments of gsoSize
+// bytes of payload it was made of, as GSO would: the sequence number
+// advances, CWR is only kept on the first segment, PSH and FIN only on the
+// last one. The checksum is left as is, it is not verified. The last slot
+// of segments gets the whole remaining payload. Returns the number of
+// segments filled.
+func splitSegment(tcp []byte, gsoSize int, segments []Segment) int {
+	headerLen := tcpHeaderLen(tcp)
+	if headerLen == 0 || gsoSize <= 0 || len(tcp)-headerLen <= gsoSize {
+		buffer := segments[0].Data[:cap(segments[0].Data)]
+		segments[0].Data = buffer[:copy(buffer, tcp)]
+		return 1
+	}
+
+	header, payload := tcp[:headerLen], tcp[headerLen:]
+	seq := binary.BigEndian.Uint32(header[4:])
+	n := 0
+	for len(payload) > 0 {
+		size := gsoSize
+		if size > len(payload) || n == len(segments)-1 {
+			size = len(payload)
+		}
+		buffer := segments[n].Data[:cap(segments[n].Data)]
+		copy(buffer, header)
+		segment := buffer[:headerLen+copy(buffer[headerLen:], payload[:size])]
+		binary.BigEndian.PutUint32(segment[4:], seq)
+		if n > 0 {
+			segment[tcpFlagsOffset] &^= tcpFlagCWR
+		}
+		if size < len(payload) {
+			segment[tcpFlagsOffset] &^= tcpFlagPSH | tcpFlagFIN
+		}
+		segments[n].Data = segment
+		n++
+		seq += uint32(size)
+		payload = payload[size:]
+	}
+	return n
+}
+
+func tcpHeaderLen(segment []byte) int {
+	if len(segment) < 20 {
+		return 0
+	}
+	length := int(segment[12]>>4) * 4
+	if length < 20 || length > len(segment) {
+		return 0
+	}
+	return length
+}
+
+// Headers equal apart from the sequence number, the flags and the checksum
+func sameTCPHeader(a, b []byte, headerLen int) bool {
+	return bytes.Equal(a[:4], b[:4]) && bytes.Equal(a[8:tcpFlagsOffset], b[8:tcpFlagsOffset]) &&
+		bytes.Equal(a[14:16], b[14:16]) && bytes.Equal(a[18:headerLen], b[18:headerLen])
+}
+
+// Folded, not complemented, sum of the TCP pseudo header
+func pseudoHeaderSum(src, dst uint32, length int) uint16 {
+	sum := src>>16 + src&0xffff + dst>>16 + dst&0xffff + ProtocolTCP + uint32(length)
+	for sum>>16 > 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}